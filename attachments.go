@@ -0,0 +1,736 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+type Attachment struct {
+	ID          int
+	NoteID      int
+	UserID      int
+	Filename    string
+	ContentType string
+	Size        int64
+	Hash        string
+	// Width and Height are the size of images variants can be generated for, and zero for everything else
+	Width  int
+	Height int
+}
+
+// IsImage reports whether thumbnails and width variants can be generated for the attachment
+func (a Attachment) IsImage() bool {
+	return variantContentTypes[a.ContentType]
+}
+
+// defaultMaxUploadMB is the largest upload accepted, in megabytes, when GONOTE_MAX_UPLOAD_MB is not set
+const defaultMaxUploadMB = 10
+
+// attachmentLinkExpiry is how long the download links handed out by blob stores that support them work for
+const attachmentLinkExpiry = 15 * time.Minute
+
+// inlineContentTypes are the types of attachment shown in the browser. Everything else is served as a download,
+// so an uploaded HTML or SVG file can never run scripts on this site.
+var inlineContentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// attachmentReference matches an attachment:ID reference in Markdown source
+var attachmentReference = regexp.MustCompile(`attachment:([0-9]+)`)
+
+// attachmentLinks resolves attachment:ID references to URLs for mdToHTML
+type attachmentLinks struct {
+	// urls maps the IDs of the attachments a document may reference to the URLs they are served from
+	urls map[int]string
+	// images holds what is needed to render the attachments that have width variants as responsive images
+	images map[int]attachmentImage
+}
+
+// attachmentImage describes an image attachment with width variants
+type attachmentImage struct {
+	// Src is the URL of the largest variant, used by browsers that don't support srcset
+	Src    string
+	Srcset string
+	// Width and Height are the size of the original, or zero if it isn't known
+	Width  int
+	Height int
+}
+
+// url returns the URL an attachment:ID destination points to, or an empty string if it can't be resolved
+func (l *attachmentLinks) url(destination string) string {
+	if l == nil {
+		return ""
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(destination, "attachment:"))
+	if err != nil {
+		return ""
+	}
+	return l.urls[id]
+}
+
+// image returns the responsive image an attachment:ID destination points to, if it is one
+func (l *attachmentLinks) image(destination string) (attachmentImage, bool) {
+	if l == nil {
+		return attachmentImage{}, false
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(destination, "attachment:"))
+	if err != nil {
+		return attachmentImage{}, false
+	}
+	image, ok := l.images[id]
+	return image, ok
+}
+
+// key returns the resolved URLs as a string, so renderings are cached per set of attachment URLs
+func (l *attachmentLinks) key() string {
+	if l == nil {
+		return ""
+	}
+
+	ids := make([]int, 0, len(l.urls))
+	for id := range l.urls {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var b strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&b, "%d=%s;", id, l.urls[id])
+		if image, ok := l.images[id]; ok {
+			fmt.Fprintf(&b, "%dx%d;", image.Width, image.Height)
+		}
+	}
+	return b.String()
+}
+
+// maxUploadSize reads the largest accepted upload from the GONOTE_MAX_UPLOAD_MB environment variable, in bytes
+func maxUploadSize() int64 {
+	mb, err := strconv.Atoi(os.Getenv("GONOTE_MAX_UPLOAD_MB"))
+	if err != nil || mb <= 0 {
+		mb = defaultMaxUploadMB
+	}
+	return int64(mb) << 20
+}
+
+// Signed attachment URLs on sharelinks work for a week, and those in exports, which are kept around, for a month.
+// Expiries are rounded up to the next day, so pages render the same URLs all day and stay in the render cache.
+const (
+	pageAttachmentLinkLifetime   = 7 * 24 * time.Hour
+	exportAttachmentLinkLifetime = 30 * 24 * time.Hour
+)
+
+// attachmentAccess is how the URLs of attachments are made. The zero value makes plain URLs, for logged in users
+// who can view the note. Signed URLs work without logging in until they expire, and if they have a scope only as
+// long as the sharelink or published note they were handed out on still shows the attachment, see attachmentLinkValid.
+type attachmentAccess struct {
+	Signed  bool
+	Scope   string
+	Expires int64
+}
+
+// signedAttachmentAccess returns the access of signed URLs with a scope that work for at least the lifetime
+func signedAttachmentAccess(scope string, lifetime time.Duration) attachmentAccess {
+	expires := time.Now().UTC().Truncate(24 * time.Hour).Add(lifetime + 24*time.Hour)
+	return attachmentAccess{Signed: true, Scope: scope, Expires: expires.Unix()}
+}
+
+// sharelinkAttachmentAccess returns the access of attachments shown on a sharelink
+func sharelinkAttachmentAccess(sharelinkID string) attachmentAccess {
+	return signedAttachmentAccess("sharelink-"+sharelinkID, pageAttachmentLinkLifetime)
+}
+
+// publishedAttachmentLinkExpiry is the expiry of attachment URLs on published notes and in feeds. Feed readers and
+// caches keep these around indefinitely, so they don't expire and stop working once the note is unpublished instead.
+var publishedAttachmentLinkExpiry = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// publishedAttachmentAccess returns the access of attachments shown on a published note and in feeds
+func publishedAttachmentAccess(noteID int) attachmentAccess {
+	return attachmentAccess{Signed: true, Scope: fmt.Sprintf("note-%d", noteID), Expires: publishedAttachmentLinkExpiry.Unix()}
+}
+
+// exportAttachmentAccess returns the access of attachments linked from exported files, which only expire
+func exportAttachmentAccess() attachmentAccess {
+	return signedAttachmentAccess("", exportAttachmentLinkLifetime)
+}
+
+// attachmentURL returns the address an attachment is served from
+func attachmentURL(id int, access attachmentAccess) string {
+	if access.Signed {
+		query := url.Values{"exp": {strconv.FormatInt(access.Expires, 10)}}
+		if access.Scope != "" {
+			query.Set("scope", access.Scope)
+		}
+		query.Set("sig", signAttachment(id, access.Scope, access.Expires))
+		return fmt.Sprintf("/api/attachments/%d?%s", id, query.Encode())
+	}
+	return fmt.Sprintf("/api/attachments/%d", id)
+}
+
+// attachmentLinkValid reports whether a request for an attachment has a signed URL for it that hasn't expired,
+// and whose sharelink or published note still shows it: the sharelink must exist and have been unlocked if it
+// has a password, the note must still be published, and both must belong to the owner of the attachment.
+func (app *App) attachmentLinkValid(r *http.Request, attachment Attachment) bool {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	scope := query.Get("scope")
+	if !validAttachmentSignature(attachment.ID, scope, expires, query.Get("sig")) {
+		return false
+	}
+
+	if sharelinkID, ok := strings.CutPrefix(scope, "sharelink-"); ok {
+		sharelink := app.getSharelinkContent(sharelinkID)
+		return sharelink.ID != "" && sharelink.UserID == attachment.UserID &&
+			(len(sharelink.Password) == 0 || isSharelinkUnlocked(r, sharelinkID))
+	}
+	if noteID, ok := strings.CutPrefix(scope, "note-"); ok {
+		var published bool
+		err = app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM notes WHERE id = $1 AND user_id = $2 AND published)", noteID, attachment.UserID).Scan(&published)
+		if err != nil {
+			app.log.Println("Error checking published note of attachment: ", err.Error())
+		}
+		return published
+	}
+	return scope == ""
+}
+
+// getAttachmentLinks resolves the attachments referenced in Markdown source. Only attachments owned by
+// the owner of the document are resolved, so nobody can embed another user's files.
+func (app *App) getAttachmentLinks(md string, ownerID int, access attachmentAccess) *attachmentLinks {
+	links := &attachmentLinks{urls: make(map[int]string), images: make(map[int]attachmentImage)}
+
+	var ids []int64
+	for _, match := range attachmentReference.FindAllStringSubmatch(md, -1) {
+		id, err := strconv.ParseInt(match[1], 10, 32)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return links
+	}
+
+	rows, err := app.db.Query("SELECT id, content_type, width, height FROM attachments WHERE user_id = $1 AND id = ANY($2)", ownerID, pq.Array(ids))
+	if err != nil {
+		app.log.Println("Error resolving attachments: ", err.Error())
+		return links
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachment Attachment
+		rows.Scan(&attachment.ID, &attachment.ContentType, &attachment.Width, &attachment.Height)
+		links.urls[attachment.ID] = attachmentURL(attachment.ID, access)
+
+		if attachment.IsImage() {
+			links.images[attachment.ID] = attachmentImage{
+				Src:    attachmentVariantURL(attachment.ID, imageVariantWidths[len(imageVariantWidths)-1], access),
+				Srcset: imageSrcset(attachment.ID, attachment.Width, access),
+				Width:  attachment.Width,
+				Height: attachment.Height,
+			}
+		}
+	}
+
+	return links
+}
+
+// getReferencedAttachments returns the attachments referenced in Markdown source that are owned by the owner of
+// the document, for exports that package or link them
+func (app *App) getReferencedAttachments(md string, ownerID int) ([]Attachment, error) {
+	var ids []int64
+	for _, match := range attachmentReference.FindAllStringSubmatch(md, -1) {
+		id, err := strconv.ParseInt(match[1], 10, 32)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	var attachments []Attachment
+	rows, err := app.db.Query("SELECT id, note_id, user_id, filename, content_type, size, hash, width, height FROM attachments WHERE user_id = $1 AND id = ANY($2) ORDER BY id", ownerID, pq.Array(ids))
+	if err != nil {
+		return attachments, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachment Attachment
+		rows.Scan(&attachment.ID, &attachment.NoteID, &attachment.UserID, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.Hash, &attachment.Width, &attachment.Height)
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+// getAttachments returns the attachments of a note, oldest first
+func (app *App) getAttachments(noteID int) []Attachment {
+	var attachments []Attachment
+	rows, err := app.db.Query("SELECT id, note_id, user_id, filename, content_type, size, hash, width, height FROM attachments WHERE note_id = $1 ORDER BY id", noteID)
+	if err != nil {
+		app.log.Println("Error getting attachments: ", err.Error())
+		return attachments
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachment Attachment
+		rows.Scan(&attachment.ID, &attachment.NoteID, &attachment.UserID, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.Hash, &attachment.Width, &attachment.Height)
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments
+}
+
+// getAttachment returns an attachment by ID. If there is none, the returned Attachment has an ID of 0.
+func (app *App) getAttachment(id int) Attachment {
+	var attachment Attachment
+	row := app.db.QueryRow("SELECT id, note_id, user_id, filename, content_type, size, hash, width, height FROM attachments WHERE id = $1", id)
+	err := row.Scan(&attachment.ID, &attachment.NoteID, &attachment.UserID, &attachment.Filename, &attachment.ContentType, &attachment.Size, &attachment.Hash, &attachment.Width, &attachment.Height)
+	if err != nil {
+		return Attachment{}
+	}
+
+	return attachment
+}
+
+// lockBlob takes a lock on the blob with the given hash that is held until the transaction ends. Saving an
+// attachment and deleting unused blobs both hold it, so a blob can't be deleted between an upload finding it
+// already stored and the attachment referring to it being inserted.
+func lockBlob(tx *sql.Tx, hash string) error {
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", hash)
+	return err
+}
+
+// blobInUse reports whether any attachment still refers to the blob with the given hash
+func blobInUse(tx *sql.Tx, hash string) (bool, error) {
+	var used bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM attachments WHERE hash = $1)", hash).Scan(&used)
+	return used, err
+}
+
+// deleteUnusedBlobs removes the blobs with the given hashes that no attachment refers to anymore, along with their image variants
+func (app *App) deleteUnusedBlobs(hashes []string) {
+	for _, hash := range hashes {
+		err := app.deleteUnusedBlob(hash)
+		if err != nil {
+			app.log.Println("Error deleting blob: ", err.Error())
+		}
+	}
+}
+
+// deleteUnusedBlob removes the blob with the given hash and its image variants if no attachment refers to it
+func (app *App) deleteUnusedBlob(hash string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = lockBlob(tx, hash)
+	if err != nil {
+		return err
+	}
+	used, err := blobInUse(tx, hash)
+	if err != nil || used {
+		return err
+	}
+
+	err = app.blobs.delete(hash)
+	if err != nil {
+		return err
+	}
+	err = app.deleteImageVariants(hash)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getAttachmentHashes returns the blob hashes of every attachment of a note, for cleaning up after it is deleted
+func (app *App) getAttachmentHashes(noteID int) []string {
+	var hashes []string
+	for _, attachment := range app.getAttachments(noteID) {
+		hashes = append(hashes, attachment.Hash)
+	}
+	return hashes
+}
+
+// saveAttachment stores an uploaded file and attaches it to a note. Files are stored once per content hash,
+// and uploading a file the note already has returns the existing attachment.
+func (app *App) saveAttachment(note Note, userID int, filename string, file io.ReadSeeker) (Attachment, error) {
+	//Sniff the type from the contents rather than trusting the browser
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return Attachment{}, err
+	}
+	contentType := http.DetectContentType(head[:n])
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	//Originals are served as they are stored, so where photos were taken is dropped before storing them
+	if contentType == "image/jpeg" || contentType == "image/png" {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return Attachment{}, err
+		}
+		file = bytes.NewReader(stripImageMetadata(data))
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return Attachment{}, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	var existing int
+	err = app.db.QueryRow("SELECT id FROM attachments WHERE note_id = $1 AND hash = $2", note.ID, sum).Scan(&existing)
+	if err == nil {
+		return app.getAttachment(existing), nil
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer tx.Rollback()
+
+	err = lockBlob(tx, sum)
+	if err != nil {
+		return Attachment{}, err
+	}
+	used, err := blobInUse(tx, sum)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if !used {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return Attachment{}, err
+		}
+		err = app.blobs.put(sum, file)
+		if err != nil {
+			return Attachment{}, err
+		}
+	}
+
+	//Attachments count towards the owner of the note, whoever uploaded them
+	attachment := Attachment{
+		NoteID:      note.ID,
+		UserID:      note.UserID,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		Hash:        sum,
+	}
+	if attachment.IsImage() {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return Attachment{}, err
+		}
+		attachment.Width, attachment.Height = imageSize(file)
+	}
+
+	err = tx.QueryRow(`INSERT INTO attachments(note_id, user_id, filename, content_type, size, hash, width, height)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		attachment.NoteID, attachment.UserID, attachment.Filename, attachment.ContentType, attachment.Size, attachment.Hash,
+		attachment.Width, attachment.Height).Scan(&attachment.ID)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	return attachment, nil
+}
+
+// deleteAttachment removes an attachment from its note and deletes its blob if nothing else uses it
+func (app *App) deleteAttachment(attachment Attachment) error {
+	_, err := app.db.Exec("DELETE FROM attachments WHERE id = $1", attachment.ID)
+	if err != nil {
+		return err
+	}
+
+	app.deleteUnusedBlobs([]string{attachment.Hash})
+	return nil
+}
+
+// cleanFilename reduces the name of an uploaded file to its base name, without any directories
+func cleanFilename(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "file"
+	}
+	if len(name) > 255 {
+		name = name[len(name)-255:]
+	}
+	return name
+}
+
+// getEditableNoteFromRequest reads the note ID from the URL and returns the note if the logged in user can edit it.
+// If they can't, it writes an error to the ResponseWriter and returns false.
+func (app *App) getEditableNoteFromRequest(w http.ResponseWriter, r *http.Request) (Note, bool) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return Note{}, false
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return Note{}, false
+	}
+
+	note := app.getNoteByID(id, userID)
+	if !note.CanEdit() {
+		app.sendErrorToastNoSwap(w, "You don't have permission to edit this note")
+		return Note{}, false
+	}
+
+	return note, true
+}
+
+// renderAttachments renders the attachments panel of a note to the ResponseWriter
+func (app *App) renderAttachments(w http.ResponseWriter, noteID int) {
+	data := struct {
+		NoteID         int
+		Attachments    []Attachment
+		ThumbnailWidth int
+	}{
+		noteID,
+		app.getAttachments(noteID),
+		thumbnailWidth,
+	}
+
+	err := app.templates.ExecuteTemplate(w, "attachments", data)
+	if err != nil {
+		app.log.Println("Error executing attachments template: ", err.Error())
+	}
+}
+
+// handleGetAttachments renders the attachments of a note, for users who can edit it
+func (app *App) handleGetAttachments(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getEditableNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	app.renderAttachments(w, note.ID)
+}
+
+// handleUploadAttachment attaches the file in the multipart form request to a note
+func (app *App) handleUploadAttachment(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getEditableNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	//Leave room for the rest of the multipart body on top of the file itself
+	maxSize := maxUploadSize()
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			app.sendErrorToastNoSwap(w, fmt.Sprintf("Files can be at most %d MB", maxSize>>20))
+			return
+		}
+		app.sendErrorToastNoSwap(w, "No file was uploaded")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxSize {
+		app.sendErrorToastNoSwap(w, fmt.Sprintf("Files can be at most %d MB", maxSize>>20))
+		return
+	}
+
+	//Attachments count towards the quota of the owner of the note, whoever uploads them
+	exceeded, err := app.quotaExceeded(note.UserID, Usage{AttachmentBytes: header.Size})
+	if err != nil {
+		app.log.Println("Error checking quota: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+	if exceeded != "" {
+		app.sendErrorToastNoSwap(w, exceeded)
+		return
+	}
+
+	_, err = app.saveAttachment(note, getUserIDFromContext(r), cleanFilename(header.Filename), file)
+	if err != nil {
+		app.log.Println("Error saving attachment: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderAttachments(w, note.ID)
+}
+
+// handleDeleteAttachment removes an attachment from a note
+func (app *App) handleDeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getEditableNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	attachmentID, err := strconv.Atoi(chi.URLParam(r, "attachmentID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attachment := app.getAttachment(attachmentID)
+	if attachment.ID == 0 || attachment.NoteID != note.ID {
+		app.sendErrorToastNoSwap(w, "Attachment not found")
+		return
+	}
+
+	err = app.deleteAttachment(attachment)
+	if err != nil {
+		app.log.Println("Error deleting attachment: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderAttachments(w, note.ID)
+}
+
+// attachmentRouter returns a router with the handlers for the "/attachments" path
+func (app *App) attachmentRouter() *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Get("/{id}", app.handleGetAttachment)
+
+	return router
+}
+
+// handleGetAttachment serves the contents of an attachment to users who can view its note,
+// or to anyone with a signed URL
+func (app *App) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	attachment := app.getAttachment(id)
+	if attachment.ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !app.attachmentLinkValid(r, attachment) {
+		userID := getUserIDFromContext(r)
+		if userID == 0 || app.getNoteByID(attachment.NoteID, userID).ID == 0 {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if widthParam := r.URL.Query().Get("w"); widthParam != "" {
+		width, err := strconv.Atoi(widthParam)
+		if err != nil || !validVariantWidth(width) {
+			http.Error(w, "Invalid width", http.StatusBadRequest)
+			return
+		}
+
+		variant, err := app.getImageVariant(attachment, width)
+		if err == nil {
+			filename := strings.TrimSuffix(attachment.Filename, filepath.Ext(attachment.Filename)) + variantExtensions[variant.ContentType]
+			app.serveBlob(w, r, variant.Key, variant.ContentType, variant.Size, filename)
+			return
+		}
+		if !errors.Is(err, errNoImageVariant) {
+			app.log.Println("Error generating image variant: ", err.Error())
+		}
+	}
+
+	app.serveBlob(w, r, attachment.Hash, attachment.ContentType, attachment.Size, attachment.Filename)
+}
+
+// serveBlob sends the contents of a blob to the ResponseWriter, or redirects to it if the blob store can serve
+// it directly. Blobs are served with headers that stop browsers from running anything in them.
+func (app *App) serveBlob(w http.ResponseWriter, r *http.Request, key, contentType string, size int64, filename string) {
+	if r.Header.Get("If-None-Match") == `"`+key+`"` {
+		//A 304 repeats the caching headers of the contents, or caches stop reusing their copy
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Header().Set("ETag", `"`+key+`"`)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	disposition := "attachment"
+	if inlineContentTypes[contentType] {
+		disposition = "inline"
+	}
+	disposition = mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+
+	//Let the blob store serve the contents itself if it can
+	if presigner, ok := app.blobs.(blobPresigner); ok {
+		link, err := presigner.presignGet(key, attachmentLinkExpiry, url.Values{
+			"response-content-type":        {contentType},
+			"response-content-disposition": {disposition},
+		})
+		if err != nil {
+			app.log.Println("Error signing attachment link: ", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+
+	contents, err := app.blobs.get(key)
+	if err != nil {
+		app.log.Println("Error reading attachment: ", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer contents.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("ETag", `"`+key+`"`)
+	io.Copy(w, contents)
+}
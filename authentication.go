@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
@@ -54,6 +57,55 @@ func parseJWT(tokenString string) (int, error) {
 	}
 }
 
+// signSharelinkJWT signs a JWT that grants access to the password protected sharelink
+// with the given ID until the expiry time. It then returns the signed string.
+func signSharelinkJWT(sharelinkID string, expTime time.Time) (string, error) {
+	claims := &jwt.RegisteredClaims{
+		Subject:   sharelinkID,
+		Audience:  jwt.ClaimStrings{"sharelink"},
+		ExpiresAt: jwt.NewNumericDate(expTime),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
+
+// parseSharelinkJWT takes a tokenString as a parameter, and checks if it is a valid sharelink token.
+// It then returns the ID of the sharelink it grants access to and an error.
+func parseSharelinkJWT(tokenString string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("invalid signing method")
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	}, jwt.WithAudience("sharelink"))
+	if err != nil {
+		return "", err
+	}
+
+	if !token.Valid || claims.Subject == "" {
+		return "", errors.New("invalid token")
+	}
+
+	return claims.Subject, nil
+}
+
+// signAttachment returns the signature that lets anyone holding it download the attachment with the given ID
+// until the expiry, a Unix time, from wherever the scope allows. Signed URLs are used for attachments in
+// sharelinks, published notes and exports, where visitors aren't logged in.
+func signAttachment(attachmentID int, scope string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	fmt.Fprintf(mac, "attachment:%d:%s:%d", attachmentID, scope, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validAttachmentSignature reports whether a signature from a URL was made by signAttachment for the attachment,
+// scope and expiry, and hasn't expired yet
+func validAttachmentSignature(attachmentID int, scope string, expires int64, signature string) bool {
+	return signature != "" && time.Now().Unix() <= expires &&
+		hmac.Equal([]byte(signature), []byte(signAttachment(attachmentID, scope, expires)))
+}
+
 // getUserIDFromContext reads the userIDKey from the request context and returns it.
 // If there is an issue asserting the type as int, it returns 0 (not logged in)
 func getUserIDFromContext(r *http.Request) int {
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// backupFormat is the version of the backup file format. It goes up with every change older versions of gonote
+// couldn't restore correctly, and backups with a newer format than this are refused.
+const backupFormat = 1
+
+// How a restore treats notes, templates and sharelinks that already exist in the account. Notes and templates
+// are matched by title and name, sharelinks by ID.
+const (
+	restoreSkip      = "skip"
+	restoreOverwrite = "overwrite"
+	restoreDuplicate = "duplicate"
+)
+
+// backup is everything gonote stores about an account. Attachment contents are kept once per content hash in
+// Blobs, which is always written last so the rest of a backup can be read without them.
+// Quotas, import history, unsaved drafts and derived data such as the link index and image variants are left out,
+// they belong to the instance, are short lived or are rebuilt on restore.
+type backup struct {
+	Format     int               `json:"format"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Source     string            `json:"source"`
+	Username   string            `json:"username"`
+	Settings   backupSettings    `json:"settings"`
+	Templates  []backupTemplate  `json:"templates"`
+	Notes      []backupNote      `json:"notes"`
+	Sharelinks []backupSharelink `json:"sharelinks"`
+	Blobs      map[string][]byte `json:"blobs,omitempty"`
+}
+
+type backupSettings struct {
+	MarkdownExtensions *string `json:"markdown_extensions"`
+	DefaultTemplateID  int     `json:"default_template_id,omitempty"`
+}
+
+type backupTemplate struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type backupNote struct {
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Content     string     `json:"content"`
+	Tags        []string   `json:"tags"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Published   bool       `json:"published"`
+	Slug        string     `json:"slug,omitempty"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	// Collaborators are kept for reference but not restored, their usernames may belong to other people elsewhere
+	Collaborators []backupCollaborator `json:"collaborators,omitempty"`
+	Attachments   []backupAttachment   `json:"attachments,omitempty"`
+}
+
+type backupCollaborator struct {
+	Username   string `json:"username"`
+	Permission string `json:"permission"`
+}
+
+type backupAttachment struct {
+	ID          int       `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Hash        string    `json:"hash"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type backupSharelink struct {
+	ID        string                `json:"id"`
+	Title     string                `json:"title"`
+	Content   string                `json:"content"`
+	Password  []byte                `json:"password,omitempty"`
+	CreatedAt time.Time             `json:"created_at"`
+	Views     []backupSharelinkView `json:"views,omitempty"`
+}
+
+type backupSharelinkView struct {
+	ViewedAt        time.Time `json:"viewed_at"`
+	Referrer        string    `json:"referrer"`
+	UserAgentFamily string    `json:"user_agent_family"`
+	IsBot           bool      `json:"is_bot"`
+}
+
+// restoreCounts counts what happened to the items of one kind in a restore
+type restoreCounts struct {
+	Added       int
+	Overwritten int
+	Skipped     int
+}
+
+// RestoreResult is the outcome of restoring a backup
+type RestoreResult struct {
+	Notes      restoreCounts
+	Templates  restoreCounts
+	Sharelinks restoreCounts
+	Settings   bool
+	Problems   []string
+}
+
+// backupRouter returns a router with the handlers for the "/backup" path
+func (app *App) backupRouter() *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Get("/", app.handleDownloadBackup)
+	router.Post("/restore", app.handleRestoreBackup)
+
+	return router
+}
+
+// getBackup reads everything gonote stores about a user, except the attachment contents. It returns the hashes
+// of the attachments for the contents to be read from the blob store.
+func (app *App) getBackup(user User, source string) (backup, []string, error) {
+	b := backup{
+		Format:     backupFormat,
+		CreatedAt:  time.Now().UTC(),
+		Source:     source,
+		Username:   user.Username,
+		Templates:  []backupTemplate{},
+		Notes:      []backupNote{},
+		Sharelinks: []backupSharelink{},
+	}
+
+	var extensions sql.NullString
+	var defaultTemplate sql.NullInt64
+	err := app.db.QueryRow("SELECT markdown_extensions, default_template_id FROM user_settings WHERE user_id = $1", user.ID).
+		Scan(&extensions, &defaultTemplate)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return backup{}, nil, err
+	}
+	if extensions.Valid {
+		b.Settings.MarkdownExtensions = &extensions.String
+	}
+	b.Settings.DefaultTemplateID = int(defaultTemplate.Int64)
+
+	rows, err := app.db.Query("SELECT id, name, title, content, created_at FROM note_templates WHERE user_id = $1 ORDER BY id", user.ID)
+	if err != nil {
+		return backup{}, nil, err
+	}
+	for rows.Next() {
+		var t backupTemplate
+		err = rows.Scan(&t.ID, &t.Name, &t.Title, &t.Content, &t.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return backup{}, nil, err
+		}
+		b.Templates = append(b.Templates, t)
+	}
+	rows.Close()
+
+	notes := make(map[int]*backupNote)
+	rows, err = app.db.Query(`SELECT id, title, content, tags, created_at, updated_at, published, COALESCE(slug, ''), published_at
+		FROM notes WHERE user_id = $1 ORDER BY id`, user.ID)
+	if err != nil {
+		return backup{}, nil, err
+	}
+	for rows.Next() {
+		var n backupNote
+		err = rows.Scan(&n.ID, &n.Title, &n.Content, pq.Array(&n.Tags), &n.CreatedAt, &n.UpdatedAt, &n.Published, &n.Slug, &n.PublishedAt)
+		if err != nil {
+			rows.Close()
+			return backup{}, nil, err
+		}
+		b.Notes = append(b.Notes, n)
+	}
+	rows.Close()
+	for i := range b.Notes {
+		notes[b.Notes[i].ID] = &b.Notes[i]
+	}
+
+	rows, err = app.db.Query(`SELECT p.note_id, u.username, p.permission FROM note_permissions p
+		JOIN notes n ON n.id = p.note_id JOIN users u ON u.id = p.user_id
+		WHERE n.user_id = $1 ORDER BY u.username`, user.ID)
+	if err != nil {
+		return backup{}, nil, err
+	}
+	for rows.Next() {
+		var noteID int
+		var c backupCollaborator
+		err = rows.Scan(&noteID, &c.Username, &c.Permission)
+		if err != nil {
+			rows.Close()
+			return backup{}, nil, err
+		}
+		if note, ok := notes[noteID]; ok {
+			note.Collaborators = append(note.Collaborators, c)
+		}
+	}
+	rows.Close()
+
+	var hashes []string
+	seen := make(map[string]bool)
+	rows, err = app.db.Query("SELECT id, note_id, filename, content_type, size, hash, created_at FROM attachments WHERE user_id = $1 ORDER BY id", user.ID)
+	if err != nil {
+		return backup{}, nil, err
+	}
+	for rows.Next() {
+		var noteID int
+		var a backupAttachment
+		err = rows.Scan(&a.ID, &noteID, &a.Filename, &a.ContentType, &a.Size, &a.Hash, &a.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return backup{}, nil, err
+		}
+		note, ok := notes[noteID]
+		if !ok {
+			continue
+		}
+		note.Attachments = append(note.Attachments, a)
+		if !seen[a.Hash] {
+			seen[a.Hash] = true
+			hashes = append(hashes, a.Hash)
+		}
+	}
+	rows.Close()
+
+	sharelinks := make(map[string]int)
+	rows, err = app.db.Query("SELECT id, title, content, password, created_at FROM share_links WHERE user_id = $1 ORDER BY created_at, id", user.ID)
+	if err != nil {
+		return backup{}, nil, err
+	}
+	for rows.Next() {
+		var s backupSharelink
+		err = rows.Scan(&s.ID, &s.Title, &s.Content, &s.Password, &s.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return backup{}, nil, err
+		}
+		sharelinks[s.ID] = len(b.Sharelinks)
+		b.Sharelinks = append(b.Sharelinks, s)
+	}
+	rows.Close()
+
+	rows, err = app.db.Query(`SELECT v.sharelink_id, v.viewed_at, v.referrer, v.user_agent_family, v.is_bot FROM sharelink_views v
+		JOIN share_links s ON s.id = v.sharelink_id WHERE s.user_id = $1 ORDER BY v.id`, user.ID)
+	if err != nil {
+		return backup{}, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var v backupSharelinkView
+		err = rows.Scan(&id, &v.ViewedAt, &v.Referrer, &v.UserAgentFamily, &v.IsBot)
+		if err != nil {
+			return backup{}, nil, err
+		}
+		if i, ok := sharelinks[id]; ok {
+			b.Sharelinks[i].Views = append(b.Sharelinks[i].Views, v)
+		}
+	}
+
+	return b, hashes, rows.Err()
+}
+
+// writeBackup writes a backup of a user's account as JSON. The attachment contents are streamed from the blob
+// store one at a time at the end of the file, so no more than one of them is held in memory.
+func (app *App) writeBackup(out io.Writer, user User, source string) error {
+	b, hashes, err := app.getBackup(user, source)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	//Leave the object open and add the blobs to it
+	_, err = out.Write(data[:len(data)-1])
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, `,"blobs":{`)
+	if err != nil {
+		return err
+	}
+	for i, hash := range hashes {
+		if i > 0 {
+			_, err = io.WriteString(out, ",")
+			if err != nil {
+				return err
+			}
+		}
+		err = app.writeBackupBlob(out, hash)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(out, "}}\n")
+	return err
+}
+
+// writeBackupBlob writes the contents of a blob as a member of the blobs object of a backup, base64 encoded
+// the way encoding/json reads []byte
+func (app *App) writeBackupBlob(out io.Writer, hash string) error {
+	blob, err := app.blobs.get(hash)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	_, err = fmt.Fprintf(out, `%q:"`, hash)
+	if err != nil {
+		return err
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, out)
+	_, err = io.Copy(encoder, blob)
+	if err != nil {
+		return err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, `"`)
+	return err
+}
+
+// remapAttachments points the attachment references of Markdown at the attachments they were restored as.
+// References to attachments that weren't restored are left alone.
+func remapAttachments(content string, ids map[int]int) string {
+	return attachmentReference.ReplaceAllStringFunc(content, func(reference string) string {
+		id, err := strconv.Atoi(strings.TrimPrefix(reference, "attachment:"))
+		if err != nil {
+			return reference
+		}
+		if restored, ok := ids[id]; ok {
+			return fmt.Sprintf("attachment:%d", restored)
+		}
+		return reference
+	})
+}
+
+// restoredName returns a name for a duplicate of something restored next to an existing one of the same name,
+// which isn't in taken. The names in taken are keyed by wikiLinkKey.
+func restoredName(name string, taken map[string]bool) string {
+	restored := name + " (restored)"
+	for n := 2; taken[wikiLinkKey(restored)]; n++ {
+		restored = fmt.Sprintf("%s (restored %d)", name, n)
+	}
+	return restored
+}
+
+// restoreBackup imports a backup into a user's account, giving everything in it new IDs and rewriting the
+// references between them. conflict is one of restoreSkip, restoreOverwrite or restoreDuplicate. Problems with
+// single items are reported in the result and don't stop the rest from being restored.
+func (app *App) restoreBackup(userID int, b backup, conflict string) RestoreResult {
+	var result RestoreResult
+	problem := func(format string, args ...any) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+	}
+
+	//Notes go first, everything else can refer to their attachments.
+	//Titles aren't unique, so every note that existed before the restore can be matched by one note of the
+	//backup at most. Notes restored along the way are never matched, or repeated titles would clash with each other.
+	existingNotes := make(map[string][]int)
+	taken := make(map[string]bool)
+	rows, err := app.db.Query("SELECT id, title FROM notes WHERE user_id = $1", userID)
+	if err != nil {
+		app.log.Println("Error getting notes for restore: ", err.Error())
+		problem("Internal server error")
+		return result
+	}
+	for rows.Next() {
+		var id int
+		var title string
+		rows.Scan(&id, &title)
+		existingNotes[wikiLinkKey(title)] = append(existingNotes[wikiLinkKey(title)], id)
+		taken[wikiLinkKey(title)] = true
+	}
+	rows.Close()
+
+	attachmentIDs := make(map[int]int)
+	var restored []backupNote
+	for _, n := range b.Notes {
+		var existing int
+		if matches := existingNotes[wikiLinkKey(n.Title)]; len(matches) > 0 {
+			existing = matches[0]
+			existingNotes[wikiLinkKey(n.Title)] = matches[1:]
+		}
+		if existing != 0 && conflict == restoreSkip {
+			result.Notes.Skipped++
+			//Keep the existing note's copies of the same files, so references to them still work
+			for _, a := range n.Attachments {
+				var id int
+				err = app.db.QueryRow("SELECT id FROM attachments WHERE note_id = $1 AND hash = $2", existing, a.Hash).Scan(&id)
+				if err == nil {
+					attachmentIDs[a.ID] = id
+				}
+			}
+			continue
+		}
+		if existing != 0 && conflict == restoreDuplicate {
+			n.Title = restoredName(n.Title, taken)
+			existing = 0
+		}
+
+		note, message := app.restoreNote(userID, existing, n)
+		if message != "" {
+			problem("Note %q: %s", n.Title, message)
+			continue
+		}
+		if existing != 0 {
+			result.Notes.Overwritten++
+		} else {
+			result.Notes.Added++
+		}
+		taken[wikiLinkKey(n.Title)] = true
+
+		for _, a := range n.Attachments {
+			data, ok := b.Blobs[a.Hash]
+			if !ok {
+				problem("Note %q: the backup is missing the contents of %s", n.Title, a.Filename)
+				continue
+			}
+			attachment, err := app.importAttachment(note, a.Filename, data)
+			if err != nil {
+				problem("Note %q: could not restore %s: %s", n.Title, a.Filename, err.Error())
+				continue
+			}
+			attachmentIDs[a.ID] = attachment.ID
+		}
+
+		n.ID = note.ID
+		restored = append(restored, n)
+	}
+
+	for _, n := range restored {
+		content := remapAttachments(n.Content, attachmentIDs)
+		if content != n.Content {
+			_, err = app.db.Exec("UPDATE notes SET content = $1, version = version + 1 WHERE id = $2", content, n.ID)
+			if err != nil {
+				app.log.Println("Error remapping restored attachments: ", err.Error())
+				problem("Note %q: could not update its attachment links", n.Title)
+				content = n.Content
+			}
+		}
+		err = app.saveNoteLinks(n.ID, content)
+		if err != nil {
+			app.log.Println("Error indexing note links: ", err.Error())
+		}
+	}
+
+	templateIDs := app.restoreTemplates(userID, b.Templates, conflict, attachmentIDs, &result)
+	app.restoreSharelinks(userID, b.Sharelinks, conflict, attachmentIDs, &result)
+
+	if b.Settings.MarkdownExtensions != nil || b.Settings.DefaultTemplateID != 0 {
+		var exists bool
+		err = app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_settings WHERE user_id = $1)", userID).Scan(&exists)
+		if err != nil {
+			app.log.Println("Error checking settings for restore: ", err.Error())
+			problem("Settings: Internal server error")
+		} else if !exists || conflict == restoreOverwrite {
+			var extensions sql.NullString
+			if b.Settings.MarkdownExtensions != nil {
+				extensions = sql.NullString{String: *b.Settings.MarkdownExtensions, Valid: true}
+			}
+			var defaultTemplate sql.NullInt64
+			if id, ok := templateIDs[b.Settings.DefaultTemplateID]; ok {
+				defaultTemplate = sql.NullInt64{Int64: int64(id), Valid: true}
+			}
+
+			_, err = app.db.Exec(`INSERT INTO user_settings(user_id, markdown_extensions, default_template_id) VALUES($1, $2, $3)
+				ON CONFLICT (user_id) DO UPDATE SET markdown_extensions = EXCLUDED.markdown_extensions,
+				default_template_id = EXCLUDED.default_template_id`, userID, extensions, defaultTemplate)
+			if err != nil {
+				app.log.Println("Error restoring settings: ", err.Error())
+				problem("Settings: Internal server error")
+			} else {
+				result.Settings = true
+			}
+		}
+	}
+
+	return result
+}
+
+// restoreNote creates a note from a backup, or overwrites the note with ID existing with it. It returns a
+// message for the user if the note couldn't be restored.
+func (app *App) restoreNote(userID, existing int, n backupNote) (Note, string) {
+	change := Usage{NoteBytes: int64(len(n.Title) + len(n.Content))}
+	if existing == 0 {
+		change.Notes = 1
+	} else {
+		var size int64
+		err := app.db.QueryRow("SELECT octet_length(title) + octet_length(content) FROM notes WHERE id = $1", existing).Scan(&size)
+		if err != nil {
+			app.log.Println("Error getting size of overwritten note: ", err.Error())
+			return Note{}, "Internal server error"
+		}
+		change.NoteBytes -= size
+	}
+	exceeded, err := app.quotaExceeded(userID, change)
+	if err != nil {
+		app.log.Println("Error checking quota: ", err.Error())
+		return Note{}, "Internal server error"
+	}
+	if exceeded != "" {
+		return Note{}, exceeded
+	}
+
+	//Slugs only have to be unique within the account, keep the old one unless another note has it
+	var slug sql.NullString
+	if n.Slug != "" {
+		slug.String, err = app.uniqueSlug(userID, existing, n.Slug)
+		if err != nil {
+			app.log.Println("Error generating slug for restored note: ", err.Error())
+			return Note{}, "Internal server error"
+		}
+		slug.Valid = true
+	}
+	if n.Published && n.PublishedAt == nil {
+		now := time.Now()
+		n.PublishedAt = &now
+	}
+	if n.Tags == nil {
+		n.Tags = []string{}
+	}
+
+	note := Note{ID: existing, UserID: userID}
+	if existing == 0 {
+		err = app.db.QueryRow(`INSERT INTO notes(user_id, title, content, tags, created_at, updated_at, published, slug, published_at)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+			userID, n.Title, n.Content, pq.Array(n.Tags), n.CreatedAt, n.UpdatedAt, n.Published, slug, n.PublishedAt).Scan(&note.ID)
+	} else {
+		_, err = app.db.Exec(`UPDATE notes SET title = $1, content = $2, tags = $3, created_at = $4, updated_at = $5, published = $6,
+			slug = $7, published_at = $8, version = version + 1 WHERE id = $9`,
+			n.Title, n.Content, pq.Array(n.Tags), n.CreatedAt, n.UpdatedAt, n.Published, slug, n.PublishedAt, existing)
+	}
+	if err != nil {
+		app.log.Println("Error restoring note: ", err.Error())
+		return Note{}, "Internal server error"
+	}
+
+	return note, ""
+}
+
+// restoreTemplates restores the note templates of a backup and returns the IDs they were restored as, by their
+// IDs in the backup
+func (app *App) restoreTemplates(userID int, templates []backupTemplate, conflict string, attachmentIDs map[int]int, result *RestoreResult) map[int]int {
+	ids := make(map[int]int)
+	//Like notes, each template that existed before the restore is matched by one template of the backup at most
+	existingTemplates := make(map[string][]int)
+	taken := make(map[string]bool)
+	rows, err := app.db.Query("SELECT id, name FROM note_templates WHERE user_id = $1", userID)
+	if err != nil {
+		app.log.Println("Error getting templates for restore: ", err.Error())
+		result.Problems = append(result.Problems, "Templates: Internal server error")
+		return ids
+	}
+	for rows.Next() {
+		var id int
+		var name string
+		rows.Scan(&id, &name)
+		existingTemplates[wikiLinkKey(name)] = append(existingTemplates[wikiLinkKey(name)], id)
+		taken[wikiLinkKey(name)] = true
+	}
+	rows.Close()
+
+	for _, t := range templates {
+		content := remapAttachments(t.Content, attachmentIDs)
+		var existing int
+		if matches := existingTemplates[wikiLinkKey(t.Name)]; len(matches) > 0 {
+			existing = matches[0]
+			existingTemplates[wikiLinkKey(t.Name)] = matches[1:]
+		}
+
+		switch {
+		case existing != 0 && conflict == restoreSkip:
+			ids[t.ID] = existing
+			result.Templates.Skipped++
+			continue
+		case existing != 0 && conflict == restoreOverwrite:
+			_, err = app.db.Exec("UPDATE note_templates SET title = $1, content = $2 WHERE id = $3", t.Title, content, existing)
+			if err != nil {
+				app.log.Println("Error restoring template: ", err.Error())
+				result.Problems = append(result.Problems, fmt.Sprintf("Template %q: Internal server error", t.Name))
+				continue
+			}
+			ids[t.ID] = existing
+			result.Templates.Overwritten++
+			continue
+		case existing != 0:
+			t.Name = restoredName(t.Name, taken)
+		}
+
+		var id int
+		err = app.db.QueryRow("INSERT INTO note_templates(user_id, name, title, content, created_at) VALUES($1, $2, $3, $4, $5) RETURNING id",
+			userID, t.Name, t.Title, content, t.CreatedAt).Scan(&id)
+		if err != nil {
+			app.log.Println("Error restoring template: ", err.Error())
+			result.Problems = append(result.Problems, fmt.Sprintf("Template %q: Internal server error", t.Name))
+			continue
+		}
+		ids[t.ID] = id
+		taken[wikiLinkKey(t.Name)] = true
+		result.Templates.Added++
+	}
+
+	return ids
+}
+
+// restoreSharelinks restores the sharelinks of a backup. Sharelinks keep their IDs, so links handed out before
+// moving to another instance keep working there, unless the ID is already taken by somebody else's sharelink.
+func (app *App) restoreSharelinks(userID int, sharelinks []backupSharelink, conflict string, attachmentIDs map[int]int, result *RestoreResult) {
+	for _, s := range sharelinks {
+		content := remapAttachments(s.Content, attachmentIDs)
+
+		id := s.ID
+		var owner int
+		err := app.db.QueryRow("SELECT COALESCE(user_id, 0) FROM share_links WHERE id = $1", id).Scan(&owner)
+		switch {
+		case err != nil && !errors.Is(err, sql.ErrNoRows):
+			app.log.Println("Error checking sharelink for restore: ", err.Error())
+			result.Problems = append(result.Problems, fmt.Sprintf("Sharelink %q: Internal server error", s.Title))
+			continue
+		case err == nil && owner == userID && conflict == restoreSkip:
+			result.Sharelinks.Skipped++
+			continue
+		case err == nil && owner == userID && conflict == restoreOverwrite:
+			_, err = app.db.Exec("UPDATE share_links SET title = $1, content = $2, password = $3 WHERE id = $4", s.Title, content, s.Password, id)
+			if err != nil {
+				app.log.Println("Error restoring sharelink: ", err.Error())
+				result.Problems = append(result.Problems, fmt.Sprintf("Sharelink %q: Internal server error", s.Title))
+				continue
+			}
+			result.Sharelinks.Overwritten++
+			continue
+		}
+
+		//Taken IDs, and anything in the backup that doesn't look like a sharelink ID, get a new one
+		taken := err == nil
+		if _, decodeErr := hex.DecodeString(id); taken || len(id) != 32 || decodeErr != nil {
+			id, err = newSharelinkID()
+			if err != nil {
+				app.log.Println("Error creating random string for sharelink: ", err.Error())
+				result.Problems = append(result.Problems, fmt.Sprintf("Sharelink %q: Internal server error", s.Title))
+				continue
+			}
+		}
+
+		_, err = app.db.Exec("INSERT INTO share_links(id, user_id, title, content, password, created_at) VALUES($1, $2, $3, $4, $5, $6)",
+			id, userID, s.Title, content, s.Password, s.CreatedAt)
+		if err != nil {
+			app.log.Println("Error restoring sharelink: ", err.Error())
+			result.Problems = append(result.Problems, fmt.Sprintf("Sharelink %q: Internal server error", s.Title))
+			continue
+		}
+		for _, v := range s.Views {
+			_, err = app.db.Exec("INSERT INTO sharelink_views(sharelink_id, viewed_at, referrer, user_agent_family, is_bot) VALUES($1, $2, $3, $4, $5)",
+				id, v.ViewedAt, v.Referrer, v.UserAgentFamily, v.IsBot)
+			if err != nil {
+				app.log.Println("Error restoring sharelink view: ", err.Error())
+				break
+			}
+		}
+		result.Sharelinks.Added++
+	}
+}
+
+// handleDownloadBackup sends a backup of the user's whole account
+func (app *App) handleDownloadBackup(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.getUserByID(userID)
+	if err != nil {
+		app.log.Println("Error getting user for backup: ", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("gonote-backup-%s-%s.json", slugify(user.Username), time.Now().Format("2006-01-02"))
+	err = app.sendArchive(w, r, filename, "application/json", func(out io.Writer) error {
+		return app.writeBackup(out, user, baseURL(r))
+	})
+	if err != nil {
+		app.log.Println("Error writing backup: ", err.Error())
+	}
+}
+
+// handleRestoreBackup restores an uploaded backup into the user's account and renders what was restored
+func (app *App) handleRestoreBackup(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	maxSize := maxImportSize()
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+
+	upload, _, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			app.sendErrorToastNoSwap(w, fmt.Sprintf("Backups can be at most %d MB", maxSize>>20))
+			return
+		}
+		app.sendErrorToastNoSwap(w, "No file was uploaded")
+		return
+	}
+	defer upload.Close()
+
+	conflict := r.FormValue("conflict")
+	if conflict != restoreSkip && conflict != restoreOverwrite && conflict != restoreDuplicate {
+		app.sendErrorToastNoSwap(w, "Choose what to do with things that already exist")
+		return
+	}
+
+	var b backup
+	err = json.NewDecoder(upload).Decode(&b)
+	if err != nil || b.Format == 0 {
+		app.sendErrorToastNoSwap(w, "The file is not a gonote backup")
+		return
+	}
+	if b.Format > backupFormat {
+		app.sendErrorToastNoSwap(w, "The backup was made by a newer version of gonote")
+		return
+	}
+
+	result := app.restoreBackup(userID, b, conflict)
+
+	err = app.templates.ExecuteTemplate(w, "backup_restore", result)
+	if err != nil {
+		app.log.Println("Error executing backup_restore template: ", err.Error())
+	}
+}
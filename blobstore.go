@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// blobStore keeps the contents of uploaded files, addressed by a key
+type blobStore interface {
+	put(key string, contents io.Reader) error
+	get(key string) (io.ReadCloser, error)
+	delete(key string) error
+}
+
+// newBlobStore returns the blob store configured by the environment. GONOTE_BLOB_BACKEND chooses between
+// "local", the default, which keeps blobs on the local filesystem in the directory named by GONOTE_BLOB_DIR
+// or "data/blobs" by default, and "s3", see newS3BlobStore.
+func newBlobStore() (blobStore, error) {
+	switch backend := os.Getenv("GONOTE_BLOB_BACKEND"); backend {
+	case "", "local":
+	case "s3":
+		return newS3BlobStore()
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q", backend)
+	}
+
+	root := os.Getenv("GONOTE_BLOB_DIR")
+	if root == "" {
+		root = filepath.Join("data", "blobs")
+	}
+
+	err := os.MkdirAll(root, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return localBlobStore{root}, nil
+}
+
+// validBlobKey refuses keys that could escape the directory or bucket blobs are kept in. Keys are content hashes
+// or other generated names, made of letters, digits, dashes and underscores.
+func validBlobKey(key string) error {
+	if len(key) < 3 || strings.IndexFunc(key, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) != -1 {
+		return errors.New("invalid blob key")
+	}
+	return nil
+}
+
+// localBlobStore keeps blobs as files in a directory, spread over subdirectories named after the
+// first two characters of their keys
+type localBlobStore struct {
+	root string
+}
+
+// path returns where the blob with the given key is kept
+func (l localBlobStore) path(key string) (string, error) {
+	err := validBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(l.root, key[:2], key), nil
+}
+
+// put writes to a temporary file first and renames it into place, so a failed upload never leaves a partial blob
+func (l localBlobStore) put(key string, contents io.Reader) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = io.Copy(file, contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func (l localBlobStore) get(key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// delete removes a blob. Deleting a blob that doesn't exist is not an error.
+func (l localBlobStore) delete(key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type Collaborator struct {
+	UserID     int
+	Username   string
+	Permission Permission
+}
+
+// getCollaborators returns every user a note has been shared with
+func (app *App) getCollaborators(noteID int) []Collaborator {
+	var collaborators []Collaborator
+	rows, err := app.db.Query(`SELECT u.id, u.username, p.permission
+		FROM note_permissions p JOIN users u ON u.id = p.user_id
+		WHERE p.note_id = $1
+		ORDER BY u.username`, noteID)
+	if err != nil {
+		app.log.Println("Error getting collaborators: ", err.Error())
+		return collaborators
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var collaborator Collaborator
+		rows.Scan(&collaborator.UserID, &collaborator.Username, &collaborator.Permission)
+		collaborators = append(collaborators, collaborator)
+	}
+
+	return collaborators
+}
+
+// setCollaborator grants a user the given permission on a note, replacing any permission they already had
+func (app *App) setCollaborator(noteID, userID int, permission Permission) error {
+	_, err := app.db.Exec(`INSERT INTO note_permissions(note_id, user_id, permission) VALUES($1, $2, $3)
+		ON CONFLICT (note_id, user_id) DO UPDATE SET permission = EXCLUDED.permission`, noteID, userID, permission)
+	return err
+}
+
+// removeCollaborator revokes a user's access to a note
+func (app *App) removeCollaborator(noteID, userID int) error {
+	_, err := app.db.Exec("DELETE FROM note_permissions WHERE note_id = $1 AND user_id = $2", noteID, userID)
+	return err
+}
+
+// getOwnedNoteFromRequest reads the note ID from the URL and returns the note if the logged in user owns it.
+// If they don't, it writes an error to the ResponseWriter and returns false.
+func (app *App) getOwnedNoteFromRequest(w http.ResponseWriter, r *http.Request) (Note, bool) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return Note{}, false
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return Note{}, false
+	}
+
+	note := app.getNoteByID(id, userID)
+	if !note.IsOwner() {
+		app.sendErrorToastNoSwap(w, "Only the owner of this note can do that")
+		return Note{}, false
+	}
+
+	return note, true
+}
+
+// renderCollaborators renders the collaborators panel of a note to the ResponseWriter
+func (app *App) renderCollaborators(w http.ResponseWriter, noteID int) {
+	data := struct {
+		NoteID        int
+		Collaborators []Collaborator
+	}{
+		noteID,
+		app.getCollaborators(noteID),
+	}
+
+	err := app.templates.ExecuteTemplate(w, "collaborators", data)
+	if err != nil {
+		app.log.Println("Error executing collaborators template: ", err.Error())
+	}
+}
+
+// handleGetCollaborators renders the users a note is shared with, for the owner of the note only
+func (app *App) handleGetCollaborators(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getOwnedNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	app.renderCollaborators(w, note.ID)
+}
+
+// handleAddCollaborator shares a note with the user named in the form request, with either view or edit permission
+func (app *App) handleAddCollaborator(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getOwnedNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	username := strings.TrimSpace(strings.ToLower(r.FormValue("username")))
+	permission := Permission(r.FormValue("permission"))
+	if permission != PermissionView && permission != PermissionEdit {
+		app.sendErrorToastNoSwap(w, "Permission must be view or edit")
+		return
+	}
+
+	user, err := app.getUserByUsername(username)
+	if err != nil {
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+	if user.ID == 0 {
+		app.sendErrorToastNoSwap(w, "User not found")
+		return
+	}
+	if user.ID == note.UserID {
+		app.sendErrorToastNoSwap(w, "You already own this note")
+		return
+	}
+
+	err = app.setCollaborator(note.ID, user.ID, permission)
+	if err != nil {
+		app.log.Println("Error adding collaborator: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderCollaborators(w, note.ID)
+}
+
+// handleRemoveCollaborator revokes a user's access to a note
+func (app *App) handleRemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getOwnedNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	collaboratorID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = app.removeCollaborator(note.ID, collaboratorID)
+	if err != nil {
+		app.log.Println("Error removing collaborator: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderCollaborators(w, note.ID)
+}
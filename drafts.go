@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// noteDraft is an edit of a note a user hasn't saved to the note yet. The editor autosaves it every few seconds,
+// and each user has at most one draft of a note.
+type noteDraft struct {
+	NoteID  int
+	UserID  int
+	Title   string
+	Content string
+	Tags    []string
+	// Base is the version of the note the draft was started from
+	Base      Note
+	UpdatedAt time.Time
+}
+
+// SavedAgo describes when the draft was last autosaved
+func (d noteDraft) SavedAgo() string {
+	return formatAgo(d.UpdatedAt)
+}
+
+// draftStatus is what the autosave indicator of the editor is rendered from
+type draftStatus struct {
+	NoteID  int
+	SavedAt time.Time
+	Error   string
+}
+
+// SavedAgo describes when the draft was last autosaved
+func (s draftStatus) SavedAgo() string {
+	return formatAgo(s.SavedAt)
+}
+
+// formatAgo describes how long ago a time was for people to read
+func formatAgo(t time.Time) string {
+	elapsed := time.Since(t)
+	switch {
+	case elapsed < 5*time.Second:
+		return "just now"
+	case elapsed < time.Minute:
+		return fmt.Sprintf("%d seconds ago", int(elapsed.Seconds()))
+	case elapsed < 2*time.Minute:
+		return "a minute ago"
+	case elapsed < time.Hour:
+		return fmt.Sprintf("%d minutes ago", int(elapsed.Minutes()))
+	case elapsed < 2*time.Hour:
+		return "an hour ago"
+	case elapsed < 24*time.Hour:
+		return fmt.Sprintf("%d hours ago", int(elapsed.Hours()))
+	default:
+		return "on " + t.Format("Jan 2, 2006")
+	}
+}
+
+// getDraft returns the user's draft of a note, and whether there is one
+func (app *App) getDraft(noteID, userID int) (noteDraft, bool) {
+	draft := noteDraft{NoteID: noteID, UserID: userID}
+	err := app.db.QueryRow(`SELECT title, content, tags, base_version, base_title, base_content, base_tags, updated_at
+		FROM note_drafts WHERE note_id = $1 AND user_id = $2`, noteID, userID).
+		Scan(&draft.Title, &draft.Content, pq.Array(&draft.Tags), &draft.Base.Version, &draft.Base.Title, &draft.Base.Content,
+			pq.Array(&draft.Base.Tags), &draft.UpdatedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.log.Println("Error getting draft: ", err.Error())
+		}
+		return noteDraft{}, false
+	}
+
+	return draft, true
+}
+
+// saveDraft stores the user's draft of a note in place of the one before, and returns when it was saved
+func (app *App) saveDraft(draft noteDraft) (time.Time, error) {
+	var savedAt time.Time
+	err := app.db.QueryRow(`INSERT INTO note_drafts(note_id, user_id, title, content, tags, base_version, base_title, base_content, base_tags)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (note_id, user_id) DO UPDATE SET title = EXCLUDED.title, content = EXCLUDED.content, tags = EXCLUDED.tags,
+		base_version = EXCLUDED.base_version, base_title = EXCLUDED.base_title, base_content = EXCLUDED.base_content,
+		base_tags = EXCLUDED.base_tags, updated_at = now()
+		RETURNING updated_at`,
+		draft.NoteID, draft.UserID, draft.Title, draft.Content, pq.Array(draft.Tags),
+		draft.Base.Version, draft.Base.Title, draft.Base.Content, pq.Array(draft.Base.Tags)).Scan(&savedAt)
+	return savedAt, err
+}
+
+// deleteDraft discards the user's draft of a note
+func (app *App) deleteDraft(noteID, userID int) error {
+	_, err := app.db.Exec("DELETE FROM note_drafts WHERE note_id = $1 AND user_id = $2", noteID, userID)
+	return err
+}
+
+// openNoteEditor returns the editor of a note, filled with the user's draft of it if there is one
+func (app *App) openNoteEditor(note Note, userID int) noteEditor {
+	editor := noteEditor{Note: note, Base: note}
+
+	draft, ok := app.getDraft(note.ID, userID)
+	if ok {
+		editor.Title, editor.Content, editor.Tags = draft.Title, draft.Content, draft.Tags
+		editor.Base = draft.Base
+		editor.Draft = &draft
+	}
+
+	return editor
+}
+
+// handleSaveDraft autosaves the editor form in the request as the user's draft of the note, then renders the
+// autosave indicator. Drafts only change when the form does, and a form that matches the note discards the draft.
+func (app *App) handleSaveDraft(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	status := draftStatus{NoteID: id}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 6*maxNoteBytes)
+	err = r.ParseForm()
+	if err != nil {
+		status.Error = fmt.Sprintf("Notes can be at most %s", formatBytes(maxNoteBytes))
+		app.renderDraftStatus(w, status)
+		return
+	}
+
+	note := app.getNoteByID(id, userID)
+	if !note.CanEdit() {
+		status.Error = "You don't have permission to edit this note"
+		app.renderDraftStatus(w, status)
+		return
+	}
+
+	draft := noteDraft{
+		NoteID:  id,
+		UserID:  userID,
+		Title:   r.FormValue("title"),
+		Content: r.FormValue("content"),
+		Tags:    parseTags(r.FormValue("tags")),
+		Base:    readNoteBase(r, note),
+	}
+	if len(draft.Title)+len(draft.Content) > maxNoteBytes {
+		status.Error = fmt.Sprintf("Notes can be at most %s", formatBytes(maxNoteBytes))
+		app.renderDraftStatus(w, status)
+		return
+	}
+
+	existing, ok := app.getDraft(id, userID)
+	switch {
+	case draft.Title == note.Title && draft.Content == note.Content && slices.Equal(draft.Tags, note.Tags):
+		//Nothing is left unsaved, like after undoing every change
+		if ok {
+			err = app.deleteDraft(id, userID)
+			if err != nil {
+				app.log.Println("Error deleting draft: ", err.Error())
+			}
+		}
+	case ok && draft.Title == existing.Title && draft.Content == existing.Content && slices.Equal(draft.Tags, existing.Tags):
+		status.SavedAt = existing.UpdatedAt
+	default:
+		status.SavedAt, err = app.saveDraft(draft)
+		if err != nil {
+			app.log.Println("Error saving draft: ", err.Error())
+			status.Error = "Could not save the draft"
+		}
+	}
+
+	app.renderDraftStatus(w, status)
+}
+
+// renderDraftStatus renders the autosave indicator of the editor to the ResponseWriter
+func (app *App) renderDraftStatus(w http.ResponseWriter, status draftStatus) {
+	err := app.templates.ExecuteTemplate(w, "draft_status", status)
+	if err != nil {
+		app.log.Println("Error executing draft_status template: ", err.Error())
+	}
+}
+
+// handleDiscardDraft deletes the user's draft of a note and reopens the editor on the saved note
+func (app *App) handleDiscardDraft(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	note := app.getNoteByID(id, userID)
+	if !note.CanEdit() {
+		app.sendErrorToastNoSwap(w, "You don't have permission to edit this note")
+		return
+	}
+
+	err = app.deleteDraft(id, userID)
+	if err != nil {
+		app.log.Println("Error deleting draft: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.templates.ExecuteTemplate(w, "edit_note", noteEditor{Note: note, Base: note})
+}
@@ -0,0 +1,73 @@
+package main
+
+// emojiShortcodes maps the supported :shortcode: names to their emoji
+var emojiShortcodes = map[string]string{
+	"+1":                       "👍",
+	"-1":                       "👎",
+	"thumbsup":                 "👍",
+	"thumbsdown":               "👎",
+	"smile":                    "😄",
+	"grin":                     "😁",
+	"joy":                      "😂",
+	"laughing":                 "😆",
+	"wink":                     "😉",
+	"blush":                    "😊",
+	"heart_eyes":               "😍",
+	"thinking":                 "🤔",
+	"neutral_face":             "😐",
+	"confused":                 "😕",
+	"cry":                      "😢",
+	"sob":                      "😭",
+	"angry":                    "😠",
+	"scream":                   "😱",
+	"sunglasses":               "😎",
+	"sweat_smile":              "😅",
+	"clap":                     "👏",
+	"pray":                     "🙏",
+	"wave":                     "👋",
+	"muscle":                   "💪",
+	"eyes":                     "👀",
+	"heart":                    "❤️",
+	"broken_heart":             "💔",
+	"fire":                     "🔥",
+	"sparkles":                 "✨",
+	"star":                     "⭐",
+	"tada":                     "🎉",
+	"rocket":                   "🚀",
+	"bulb":                     "💡",
+	"memo":                     "📝",
+	"book":                     "📖",
+	"calendar":                 "📅",
+	"pushpin":                  "📌",
+	"link":                     "🔗",
+	"lock":                     "🔒",
+	"key":                      "🔑",
+	"bug":                      "🐛",
+	"wrench":                   "🔧",
+	"hammer":                   "🔨",
+	"gear":                     "⚙️",
+	"zap":                      "⚡",
+	"warning":                  "⚠️",
+	"x":                        "❌",
+	"white_check_mark":         "✅",
+	"heavy_check_mark":         "✔️",
+	"question":                 "❓",
+	"exclamation":              "❗",
+	"construction":             "🚧",
+	"hourglass":                "⌛",
+	"coffee":                   "☕",
+	"pizza":                    "🍕",
+	"beer":                     "🍺",
+	"sun":                      "☀️",
+	"cloud":                    "☁️",
+	"snowflake":                "❄️",
+	"100":                      "💯",
+	"point_right":              "👉",
+	"point_left":               "👈",
+	"arrow_right":              "➡️",
+	"arrow_left":               "⬅️",
+	"arrow_up":                 "⬆️",
+	"arrow_down":               "⬇️",
+	"chart_with_upwards_trend": "📈",
+	"gopher":                   "🐹",
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// enexDateFormat is the format of the timestamps in Evernote exports
+const enexDateFormat = "20060102T150405Z"
+
+// enexNote is a note of an Evernote export. Its content is ENML, Evernote's dialect of XHTML.
+type enexNote struct {
+	Title     string         `xml:"title"`
+	Content   string         `xml:"content"`
+	Created   string         `xml:"created"`
+	Updated   string         `xml:"updated"`
+	Tags      []string       `xml:"tag"`
+	Resources []enexResource `xml:"resource"`
+}
+
+// enexResource is a file attached to a note of an Evernote export. The note's content refers to it by the MD5
+// hash of its data.
+type enexResource struct {
+	Data     string `xml:"data"`
+	Mime     string `xml:"mime"`
+	FileName string `xml:"resource-attributes>file-name"`
+}
+
+// enmlNode is an element or, if it has no name, a run of text of an ENML document
+type enmlNode struct {
+	Name     string
+	Attr     map[string]string
+	Text     string
+	Children []*enmlNode
+}
+
+// enmlBlocks are the ENML elements that start a new block of Markdown
+var enmlBlocks = map[string]bool{
+	"en-note": true, "div": true, "p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "blockquote": true, "pre": true, "hr": true, "table": true, "center": true,
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// newENEXDecoder returns an XML decoder lenient enough for the HTML entities and attributes Evernote lets through
+func newENEXDecoder(r io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	return decoder
+}
+
+// countENEXNotes counts the notes of an Evernote export. If the export is malformed part way through, the notes
+// before that are counted along with one more for the report of the malformed rest.
+func countENEXNotes(exportPath string) (int, error) {
+	file, err := os.Open(exportPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	decoder := newENEXDecoder(file)
+	depth, total := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			if total == 0 {
+				return 0, err
+			}
+			return total + 1, nil
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if depth == 0 && token.Name.Local != "en-export" {
+				return 0, errors.New("not an Evernote export")
+			}
+			if depth == 1 && token.Name.Local == "note" {
+				total++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// importENEX imports every note of an Evernote export. Notes that can't be read are reported and skipped, but
+// past malformed XML nothing more of the export can be read, so the rest of the notes are reported as one failure.
+func (app *App) importENEX(job ImportJob, exportPath string) error {
+	file, err := os.Open(exportPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := newENEXDecoder(file)
+	depth, index := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			app.recordImportResult(job.ID, ImportResult{Filename: fmt.Sprintf("Note %d onwards", index+1), Error: "The export is malformed from here on: " + err.Error()})
+			return nil
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if depth != 1 || token.Name.Local != "note" {
+				depth++
+				continue
+			}
+			index++
+
+			var note enexNote
+			err = decoder.DecodeElement(&note, &token)
+			if err != nil {
+				app.recordImportResult(job.ID, ImportResult{Filename: fmt.Sprintf("Note %d onwards", index), Error: "The export is malformed from here on: " + err.Error()})
+				return nil
+			}
+			app.recordImportResult(job.ID, app.importENEXNote(job.UserID, note, index))
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// importENEXNote converts a note of an Evernote export to Markdown and stores it, attaching its resources
+func (app *App) importENEXNote(userID int, note enexNote, index int) ImportResult {
+	title := strings.TrimSpace(note.Title)
+	if title == "" {
+		title = fmt.Sprintf("Untitled note %d", index)
+	}
+
+	body, err := parseENML(note.Content)
+	if err != nil {
+		return ImportResult{Filename: title, Error: "The note's content is malformed: " + err.Error()}
+	}
+
+	imported := importedNote{
+		Path:      title,
+		Title:     title,
+		Tags:      parseTags(strings.Join(note.Tags, ",")),
+		CreatedAt: parseENEXDate(note.Created),
+		UpdatedAt: parseENEXDate(note.Updated),
+	}
+	if imported.UpdatedAt.Before(imported.CreatedAt) {
+		imported.UpdatedAt = imported.CreatedAt
+	}
+
+	//Resources are attached once the note exists, until then they are left out of the content
+	imported.Content = enmlToMarkdown(body, func(attr map[string]string) string { return "" })
+	if len(imported.Title)+len(imported.Content) > maxNoteBytes {
+		return ImportResult{Filename: title, Error: fmt.Sprintf("The note is larger than %s", formatBytes(maxNoteBytes))}
+	}
+
+	return app.importNote(userID, imported, func(stored Note) (string, []string) {
+		var problems []string
+		resources := make(map[string]enexResource)
+		var hashes []string
+		for i, resource := range note.Resources {
+			data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(resource.Data), ""))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("could not read attachment %d", i+1))
+				continue
+			}
+			sum := md5.Sum(data)
+			hash := hex.EncodeToString(sum[:])
+			resource.Data = string(data)
+			if resource.FileName == "" {
+				resource.FileName = "attachment"
+				if extensions, _ := mime.ExtensionsByType(resource.Mime); len(extensions) > 0 {
+					resource.FileName += extensions[0]
+				}
+			}
+			if _, ok := resources[hash]; !ok {
+				hashes = append(hashes, hash)
+			}
+			resources[hash] = resource
+		}
+
+		attached := make(map[string]string)
+		attach := func(hash string) string {
+			if link, ok := attached[hash]; ok {
+				return link
+			}
+			resource, ok := resources[hash]
+			if !ok {
+				return ""
+			}
+
+			var err error
+			var attachment Attachment
+			if int64(len(resource.Data)) > maxUploadSize() {
+				err = fmt.Errorf("larger than %s", formatBytes(maxUploadSize()))
+			} else {
+				attachment, err = app.importAttachment(stored, resource.FileName, []byte(resource.Data))
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("could not attach %s: %s", resource.FileName, err.Error()))
+				attached[hash] = ""
+				return ""
+			}
+
+			name := strings.NewReplacer("[", "", "]", "").Replace(resource.FileName)
+			attached[hash] = fmt.Sprintf("[%s](attachment:%d)", name, attachment.ID)
+			if attachment.IsImage() {
+				attached[hash] = "!" + attached[hash]
+			}
+			return attached[hash]
+		}
+
+		content := enmlToMarkdown(body, func(attr map[string]string) string {
+			return attach(strings.ToLower(attr["hash"]))
+		})
+
+		//Resources the content doesn't show are listed after it, so they aren't lost
+		var rest []string
+		for _, hash := range hashes {
+			if _, ok := attached[hash]; !ok {
+				if link := attach(hash); link != "" {
+					rest = append(rest, "- "+strings.TrimPrefix(link, "!"))
+				}
+			}
+		}
+		if len(rest) > 0 {
+			content = strings.TrimSpace(content + "\n\n## Attachments\n\n" + strings.Join(rest, "\n"))
+		}
+
+		return content, problems
+	})
+}
+
+// parseENEXDate parses a timestamp of an Evernote export, falling back to the current time if it is missing or invalid
+func parseENEXDate(value string) time.Time {
+	date, err := time.Parse(enexDateFormat, strings.TrimSpace(value))
+	if err != nil {
+		return time.Now()
+	}
+	return date
+}
+
+// parseENML parses the content of an Evernote note into a tree
+func parseENML(content string) (*enmlNode, error) {
+	decoder := newENEXDecoder(strings.NewReader(content))
+	root := &enmlNode{}
+	stack := []*enmlNode{root}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return root, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parent := stack[len(stack)-1]
+		switch token := token.(type) {
+		case xml.StartElement:
+			node := &enmlNode{Name: strings.ToLower(token.Name.Local), Attr: make(map[string]string)}
+			for _, attr := range token.Attr {
+				node.Attr[strings.ToLower(attr.Name.Local)] = attr.Value
+			}
+			parent.Children = append(parent.Children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.Children = append(parent.Children, &enmlNode{Text: string(token)})
+		}
+	}
+}
+
+// enmlConverter converts ENML to Markdown. media returns the Markdown for an embedded resource, given the
+// attributes of its en-media element.
+type enmlConverter struct {
+	media func(attr map[string]string) string
+}
+
+// enmlToMarkdown converts a parsed ENML document to Markdown
+func enmlToMarkdown(root *enmlNode, media func(attr map[string]string) string) string {
+	converter := enmlConverter{media: media}
+	return strings.Join(converter.blocks(root.Children), "\n\n")
+}
+
+// blocks converts a list of nodes to blocks of Markdown, gathering runs of inline nodes into paragraphs
+func (c enmlConverter) blocks(nodes []*enmlNode) []string {
+	var blocks []string
+	var run strings.Builder
+
+	flush := func() {
+		lines := strings.Split(run.String(), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimSpace(line)
+		}
+		run.Reset()
+
+		text := strings.TrimSpace(strings.Join(lines, "\n"))
+		if text == "" {
+			return
+		}
+		//Evernote checkboxes sit at the start of a line of their own, which in Markdown is a task list item
+		if strings.HasPrefix(text, "[ ] ") || strings.HasPrefix(text, "[x] ") {
+			text = "- " + text
+		}
+		blocks = append(blocks, text)
+	}
+
+	for _, node := range nodes {
+		if enmlBlocks[node.Name] {
+			flush()
+			blocks = append(blocks, c.block(node)...)
+			continue
+		}
+		run.WriteString(c.inline(node))
+	}
+	flush()
+
+	return blocks
+}
+
+// block converts a block element to Markdown
+func (c enmlConverter) block(node *enmlNode) []string {
+	switch node.Name {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		text := whitespace.ReplaceAllString(c.inlines(node.Children), " ")
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		return []string{strings.Repeat("#", int(node.Name[1]-'0')) + " " + strings.TrimSpace(text)}
+	case "ul", "ol":
+		if list := c.list(node); list != "" {
+			return []string{list}
+		}
+		return nil
+	case "blockquote":
+		lines := strings.Split(strings.Join(c.blocks(node.Children), "\n\n"), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimSpace("> " + line)
+		}
+		return []string{strings.Join(lines, "\n")}
+	case "pre":
+		return []string{codeFence(enmlText(node))}
+	case "hr":
+		return []string{"---"}
+	case "table":
+		return []string{c.table(node)}
+	case "div":
+		//Evernote's code blocks are divs with a style of their own, holding one div per line
+		if strings.Contains(node.Attr["style"], "-en-codeblock") {
+			return []string{codeFence(enmlText(node))}
+		}
+	}
+	return c.blocks(node.Children)
+}
+
+// list converts a ul or ol element to a Markdown list
+func (c enmlConverter) list(node *enmlNode) string {
+	var items []string
+	number, indent := 1, ""
+	for _, child := range node.Children {
+		switch child.Name {
+		case "li":
+			marker := "- "
+			if node.Name == "ol" {
+				marker = fmt.Sprintf("%d. ", number)
+				number++
+			}
+			indent = strings.Repeat(" ", len(marker))
+
+			content := strings.Join(c.blocks(child.Children), "\n")
+			//Checkboxes are already list items, but here they are in one
+			if strings.HasPrefix(content, "- [ ] ") || strings.HasPrefix(content, "- [x] ") {
+				content = strings.TrimPrefix(content, "- ")
+			}
+			items = append(items, marker+strings.ReplaceAll(content, "\n", "\n"+indent))
+		case "ul", "ol":
+			//Evernote nests lists directly in lists, rather than in the item they belong to
+			if nested := c.list(child); nested != "" {
+				items = append(items, indent+strings.ReplaceAll(nested, "\n", "\n"+indent))
+			}
+		}
+	}
+	return strings.Join(items, "\n")
+}
+
+// table converts a table element to a Markdown table, with its first row as the header
+func (c enmlConverter) table(node *enmlNode) string {
+	var rows [][]string
+	columns := 0
+
+	var walk func(node *enmlNode)
+	walk = func(node *enmlNode) {
+		if node.Name != "tr" {
+			for _, child := range node.Children {
+				walk(child)
+			}
+			return
+		}
+
+		var row []string
+		for _, cell := range node.Children {
+			if cell.Name == "td" || cell.Name == "th" {
+				text := whitespace.ReplaceAllString(strings.Join(c.blocks(cell.Children), " "), " ")
+				row = append(row, strings.ReplaceAll(text, "|", `\|`))
+			}
+		}
+		rows = append(rows, row)
+		columns = max(columns, len(row))
+	}
+	walk(node)
+
+	if columns == 0 {
+		return ""
+	}
+
+	var lines []string
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, strings.Repeat("| --- ", columns)+"|")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// inlines converts a list of inline nodes to Markdown
+func (c enmlConverter) inlines(nodes []*enmlNode) string {
+	var text strings.Builder
+	for _, node := range nodes {
+		text.WriteString(c.inline(node))
+	}
+	return text.String()
+}
+
+// inline converts an inline node to Markdown. Block elements inside inline ones are flattened into their text.
+func (c enmlConverter) inline(node *enmlNode) string {
+	switch node.Name {
+	case "":
+		return whitespace.ReplaceAllString(strings.ReplaceAll(node.Text, "\u00a0", " "), " ")
+	case "br":
+		return "\n"
+	case "b", "strong":
+		return emphasize(c.inlines(node.Children), "**")
+	case "i", "em":
+		return emphasize(c.inlines(node.Children), "*")
+	case "s", "strike", "del":
+		return emphasize(c.inlines(node.Children), "~~")
+	case "code":
+		code := strings.TrimSpace(enmlText(node))
+		if code == "" {
+			return ""
+		}
+		return "`" + code + "`"
+	case "a":
+		text := strings.TrimSpace(c.inlines(node.Children))
+		if node.Attr["href"] == "" || text == "" {
+			return text
+		}
+		return "[" + text + "](" + node.Attr["href"] + ")"
+	case "img":
+		if node.Attr["src"] == "" {
+			return ""
+		}
+		return "![" + node.Attr["alt"] + "](" + node.Attr["src"] + ")"
+	case "en-todo":
+		if node.Attr["checked"] == "true" {
+			return "[x] "
+		}
+		return "[ ] "
+	case "en-media":
+		return c.media(node.Attr)
+	case "en-crypt":
+		//Encrypted text can't be read without the passphrase it was encrypted with
+		return ""
+	}
+	return c.inlines(node.Children)
+}
+
+// emphasize wraps text in an emphasis marker, keeping surrounding whitespace outside of it so the marker still counts
+func emphasize(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
+
+// enmlText returns the text of a node as is, with line breaks for br elements and after every div and paragraph
+func enmlText(node *enmlNode) string {
+	if node.Name == "" {
+		return strings.ReplaceAll(node.Text, "\u00a0", " ")
+	}
+	if node.Name == "br" {
+		return "\n"
+	}
+
+	var text strings.Builder
+	for _, child := range node.Children {
+		text.WriteString(enmlText(child))
+		if (child.Name == "div" || child.Name == "p") && !strings.HasSuffix(text.String(), "\n") {
+			text.WriteString("\n")
+		}
+	}
+	return text.String()
+}
+
+// codeFence wraps code in a fenced code block, with a fence longer than any run of backticks in the code
+func codeFence(code string) string {
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + "\n" + strings.Trim(code, "\n") + "\n" + fence
+}
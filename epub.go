@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// epubContainer points reading systems at the package document of an EPUB
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+// xmlEscape escapes text for use in XML content and attribute values
+func xmlEscape(s string) string {
+	var buff bytes.Buffer
+	xml.EscapeText(&buff, []byte(s))
+	return buff.String()
+}
+
+// toXHTML reserializes rendered HTML as XHTML, which EPUB requires. Parsing it the way a browser would and
+// rendering it again closes void elements and quotes every attribute.
+func toXHTML(fragment string) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if err != nil {
+		return "", err
+	}
+
+	var buff bytes.Buffer
+	for _, node := range nodes {
+		err = html.Render(&buff, node)
+		if err != nil {
+			return "", err
+		}
+	}
+	return buff.String(), nil
+}
+
+// epubChapterName returns the file name of the chapter of a note in an EPUB
+func epubChapterName(note Note) string {
+	return fmt.Sprintf("note-%d.xhtml", note.ID)
+}
+
+// writeEPUB writes notes as an EPUB 3 book with a chapter per note and a navigation document listing them.
+// The notes must have been rendered with renderExportNotes, and images holds the images they embed.
+func (app *App) writeEPUB(out io.Writer, title, author string, notes []Note, images []exportedImage) error {
+	css, err := readStylesheets("styles.css", "highlight-light.css")
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(out)
+	write := func(name, contents string) error {
+		file, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(file, contents)
+		return err
+	}
+
+	//The mimetype file has to come first and be stored uncompressed, so the file type can be read from its first bytes
+	file, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(file, "application/epub+zip")
+	if err != nil {
+		return err
+	}
+
+	err = write("META-INF/container.xml", epubContainer)
+	if err != nil {
+		return err
+	}
+	err = write("OEBPS/styles.css", css)
+	if err != nil {
+		return err
+	}
+
+	var manifest, spine, nav strings.Builder
+	for _, note := range notes {
+		content, err := toXHTML(string(note.ContentHTML))
+		if err != nil {
+			return err
+		}
+
+		name := epubChapterName(note)
+		err = write("OEBPS/"+name, fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" lang="en" xml:lang="en">
+<head>
+<meta charset="UTF-8"/>
+<title>%[1]s</title>
+<link rel="stylesheet" type="text/css" href="styles.css"/>
+</head>
+<body>
+<h1>%[1]s</h1>
+<div id="content">%[2]s</div>
+</body>
+</html>
+`, xmlEscape(note.Title), content))
+		if err != nil {
+			return err
+		}
+
+		id := strings.TrimSuffix(name, ".xhtml")
+		fmt.Fprintf(&manifest, "    <item id=\"%s\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", id, name)
+		fmt.Fprintf(&spine, "    <itemref idref=\"%s\"/>\n", id)
+		fmt.Fprintf(&nav, "      <li><a href=\"%s\">%s</a></li>\n", name, xmlEscape(note.Title))
+	}
+
+	for i, image := range images {
+		file, err := zw.Create("OEBPS/" + image.Path)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(image.Data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "    <item id=\"image-%d\" href=\"%s\" media-type=\"%s\"/>\n", i, xmlEscape(image.Path), image.ContentType)
+	}
+
+	err = write("OEBPS/nav.xhtml", fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en" xml:lang="en">
+<head>
+<meta charset="UTF-8"/>
+<title>%[1]s</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>%[1]s</h1>
+    <ol>
+%[2]s    </ol>
+  </nav>
+</body>
+</html>
+`, xmlEscape(title), nav.String()))
+	if err != nil {
+		return err
+	}
+
+	uuid := make([]byte, 16)
+	_, err = rand.Read(uuid)
+	if err != nil {
+		return err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+
+	err = write("OEBPS/content.opf", fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="en">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">urn:uuid:%x-%x-%x-%x-%x</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:creator>%s</dc:creator>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="css" href="styles.css" media-type="text/css"/>
+%s  </manifest>
+  <spine>
+%s  </spine>
+</package>
+`, uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:], xmlEscape(title), xmlEscape(author),
+		time.Now().UTC().Format("2006-01-02T15:04:05Z"), manifest.String(), spine.String()))
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// handleExportEPUB sends the selected notes as an EPUB book
+func (app *App) handleExportEPUB(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.getUserByID(userID)
+	if err != nil {
+		app.log.Println("Error getting user for EPUB export: ", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	notes := app.getSelectedNotes(r, userID)
+	if len(notes) == 0 {
+		http.Error(w, "No notes selected", http.StatusBadRequest)
+		return
+	}
+	title := exportTitle(r, notes)
+	notes, images := app.renderExportNotes(notes, userID, baseURL(r))
+
+	err = app.sendArchive(w, r, slugify(title)+".epub", "application/epub+zip", func(out io.Writer) error {
+		return app.writeEPUB(out, title, user.Username, notes, images)
+	})
+	if err != nil {
+		app.log.Println("Error exporting notes as EPUB: ", err.Error())
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// exportLinkExpiry is how long the download links of export archives kept in the blob store work for
+const exportLinkExpiry = 15 * time.Minute
+
+// exportRouter returns a router with the handlers for the "/export" path
+func (app *App) exportRouter() *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Get("/", app.handleExportNotes)
+	router.Get("/site", app.handleExportSite)
+	router.Get("/html", app.handleExportHTML)
+	router.Get("/epub", app.handleExportEPUB)
+	router.Get("/select", app.handleGetExportSelection)
+
+	return router
+}
+
+// sendArchive sends a generated archive to the client. If the blob store can hand out download links, the archive
+// is uploaded to it and the client is redirected there, so no single instance has to keep serving it. Otherwise
+// the archive is streamed straight to the ResponseWriter while it is written.
+// Archives in the blob store are never deleted by gonote, expire them with a lifecycle rule on the "export-" prefix.
+func (app *App) sendArchive(w http.ResponseWriter, r *http.Request, filename, contentType string, write func(io.Writer) error) error {
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+
+	presigner, ok := app.blobs.(blobPresigner)
+	if !ok {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", disposition)
+		return write(w)
+	}
+
+	file, err := os.CreateTemp("", "gonote-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	err = write(file)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	buff := make([]byte, 16)
+	_, err = rand.Read(buff)
+	if err != nil {
+		return err
+	}
+	key := "export-" + hex.EncodeToString(buff)
+
+	err = app.blobs.put(key, file)
+	if err != nil {
+		return err
+	}
+
+	link, err := presigner.presignGet(key, exportLinkExpiry, url.Values{
+		"response-content-type":        {contentType},
+		"response-content-disposition": {disposition},
+	})
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, link, http.StatusSeeOther)
+	return nil
+}
+
+// handleExportNotes sends a zip archive of every note of the logged in user as Markdown files
+func (app *App) handleExportNotes(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.getUserByID(userID)
+	if err != nil {
+		app.log.Println("Error getting user for notes export: ", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-notes-%s.zip", user.Username, time.Now().Format(time.DateOnly))
+	err = app.sendArchive(w, r, filename, "application/zip", func(out io.Writer) error {
+		return app.exportNotes(userID, out)
+	})
+	if err != nil {
+		app.log.Println("Error exporting notes: ", err.Error())
+	}
+}
+
+// handleExportSite sends a zip archive of a static website built from the user's published notes.
+// The "tag" query parameter limits the site to notes with that tag, and "base_url" enables the sitemap.
+func (app *App) handleExportSite(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.getUserByID(userID)
+	if err != nil {
+		app.log.Println("Error getting user for site export: ", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	opts := siteOptions{
+		Tag:     strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag"))),
+		BaseURL: r.URL.Query().Get("base_url"),
+	}
+
+	err = app.sendArchive(w, r, fmt.Sprintf("%s-site.zip", user.Username), "application/zip", func(out io.Writer) error {
+		zw := zip.NewWriter(out)
+		err := app.exportSite(user, opts, zipSiteWriter{zw})
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		app.log.Println("Error exporting site: ", err.Error())
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Link      atomLink    `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Authors     []jsonFeedAuthor `json:"authors"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type jsonFeedItem struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	Title         string `json:"title"`
+	ContentHTML   string `json:"content_html"`
+	DatePublished string `json:"date_published"`
+}
+
+// handleAtomFeed writes an Atom feed of a user's published notes to the ResponseWriter
+func (app *App) handleAtomFeed(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.getProfileUser(w, r)
+	if !ok {
+		return
+	}
+
+	profileURL := fmt.Sprintf("%s/u/%s", baseURL(r), user.Username)
+	notes := app.getPublishedNotes(user.ID)
+	opts := app.getMarkdownOptions(user.ID)
+
+	feed := atomFeed{
+		Title: user.Username + " on GoNote",
+		ID:    profileURL,
+		Links: []atomLink{
+			{Href: profileURL, Rel: "alternate", Type: "text/html"},
+			{Href: profileURL + "/feed.atom", Rel: "self", Type: "application/atom+xml"},
+		},
+		Author: atomAuthor{Name: user.Username},
+	}
+
+	//An empty feed was last updated at the epoch, otherwise when its newest note was published
+	updated := time.Unix(0, 0)
+	for _, note := range notes {
+		noteURL := profileURL + "/" + note.Slug
+		if note.PublishedAt.After(updated) {
+			updated = note.PublishedAt
+		}
+
+		opts.Attachments = app.getAttachmentLinks(note.Content, user.ID, publishedAttachmentAccess(note.ID))
+		content, _ := app.renderMarkdown(noteSource(note.ID), note.Content, opts)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     note.Title,
+			ID:        noteURL,
+			Published: note.PublishedAt.UTC().Format(time.RFC3339),
+			Updated:   note.PublishedAt.UTC().Format(time.RFC3339),
+			Link:      atomLink{Href: noteURL, Rel: "alternate", Type: "text/html"},
+			Content:   atomContent{Type: "html", Body: content},
+		})
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	err := xml.NewEncoder(w).Encode(feed)
+	if err != nil {
+		app.log.Println("Error encoding atom feed: ", err.Error())
+	}
+}
+
+// handleJSONFeed writes a JSON Feed of a user's published notes to the ResponseWriter
+func (app *App) handleJSONFeed(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.getProfileUser(w, r)
+	if !ok {
+		return
+	}
+
+	profileURL := fmt.Sprintf("%s/u/%s", baseURL(r), user.Username)
+	notes := app.getPublishedNotes(user.ID)
+	opts := app.getMarkdownOptions(user.ID)
+
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       user.Username + " on GoNote",
+		HomePageURL: profileURL,
+		FeedURL:     profileURL + "/feed.json",
+		Authors:     []jsonFeedAuthor{{Name: user.Username, URL: profileURL}},
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, note := range notes {
+		noteURL := profileURL + "/" + note.Slug
+		opts.Attachments = app.getAttachmentLinks(note.Content, user.ID, publishedAttachmentAccess(note.ID))
+		content, _ := app.renderMarkdown(noteSource(note.ID), note.Content, opts)
+		feed.Items = append(feed.Items, jsonFeedItem{
+			ID:            noteURL,
+			URL:           noteURL,
+			Title:         note.Title,
+			ContentHTML:   content,
+			DatePublished: note.PublishedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(feed)
+	if err != nil {
+		app.log.Println("Error encoding json feed: ", err.Error())
+	}
+}
@@ -8,16 +8,21 @@ require (
 )
 
 require (
+	github.com/alecthomas/chroma/v2 v2.14.0
+	github.com/go-chi/chi v1.5.5
+	github.com/go-pdf/fpdf v0.9.0
 	github.com/golang-jwt/jwt/v5 v5.0.0
 	github.com/gomarkdown/markdown v0.0.0-20230922112808-5421fefb8386
 	github.com/joho/godotenv v1.5.1
 	github.com/microcosm-cc/bluemonday v1.0.26
 	golang.org/x/crypto v0.14.0
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sync v0.4.0
 )
 
 require (
 	github.com/aymerick/douceur v0.2.0 // indirect
-	github.com/go-chi/chi v1.5.5 // indirect
+	github.com/dlclark/regexp2 v1.11.0 // indirect
 	github.com/gorilla/css v1.0.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
 )
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+var (
+	// fenceAttributes matches the opening line of a fenced code block with attributes after the language,
+	// like ```go {linenos=true hl_lines="2 4-5"}
+	fenceAttributes = regexp.MustCompile("^((?:[ \t]*>)*[ \t]*(?:```|~~~)[ \t]*)([^ \t`{}]+)[ \t]+\\{([^}]*)\\}[ \t]*$")
+	// fenceAttribute matches a single key=value attribute, where the value may be quoted or a list in brackets
+	fenceAttribute = regexp.MustCompile(`([A-Za-z_]+)(?:=("[^"]*"|\[[^\]]*\]|[^\s,]+))?`)
+)
+
+// codeBlockOptions are the settings read from the info string of a fenced code block
+type codeBlockOptions struct {
+	Language    string
+	LineNumbers bool
+	LineStart   int
+	// Highlight holds ranges of lines to highlight, counted from the first line of the block
+	Highlight [][2]int
+}
+
+// normalizeFences rewrites fence lines like ```go {linenos=true} to ```{go linenos=true}, the only form of
+// attributes the parser accepts. Lines inside other fenced code blocks are left alone.
+func normalizeFences(md string) string {
+	if !strings.Contains(md, "{") {
+		return md
+	}
+
+	lines := strings.Split(md, "\n")
+	fence := ""
+	for i, line := range lines {
+		match := fenceLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if fence != "" {
+			if match[1] == fence {
+				fence = ""
+			}
+			continue
+		}
+
+		fence = match[1]
+		lines[i] = fenceAttributes.ReplaceAllString(line, "${1}{${2} ${3}}")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// parseCodeBlockInfo reads the language and attributes from the info string of a fenced code block.
+// Supported attributes are linenos, linenostart=N and hl_lines="2 4-5", also written as hl_lines=[2,"4-5"].
+func parseCodeBlockInfo(info string) codeBlockOptions {
+	opts := codeBlockOptions{LineStart: 1}
+
+	language, attributes, _ := strings.Cut(strings.TrimSpace(info), " ")
+	opts.Language = language
+
+	for _, match := range fenceAttribute.FindAllStringSubmatch(attributes, -1) {
+		value := strings.Trim(match[2], `"[]`)
+		switch strings.ToLower(match[1]) {
+		case "linenos":
+			opts.LineNumbers = value != "false"
+		case "linenostart":
+			start, err := strconv.Atoi(value)
+			if err == nil && start > 0 {
+				opts.LineStart = start
+			}
+		case "hl_lines":
+			opts.Highlight = parseLineRanges(value)
+		}
+	}
+
+	return opts
+}
+
+// parseLineRanges turns a list like "2 4-5" or 2,"4-5" into ranges of line numbers
+func parseLineRanges(list string) [][2]int {
+	var ranges [][2]int
+	for _, field := range strings.FieldsFunc(list, func(r rune) bool { return r == ' ' || r == ',' }) {
+		first, last, isRange := strings.Cut(strings.Trim(field, `"`), "-")
+
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 1 {
+			continue
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				continue
+			}
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+
+	return ranges
+}
+
+// highlightCode writes a code block as HTML with its tokens marked by CSS classes, the themes for which
+// are in static/css. Languages the highlighter doesn't know are rendered as plain text.
+func highlightCode(w io.Writer, code string, opts codeBlockOptions) error {
+	lexer := lexers.Get(opts.Language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	iterator, err := lexer.Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+
+	//The formatter expects highlighted lines as actual line numbers, not relative to the block
+	var highlight [][2]int
+	for _, lines := range opts.Highlight {
+		highlight = append(highlight, [2]int{lines[0] + opts.LineStart - 1, lines[1] + opts.LineStart - 1})
+	}
+
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(opts.LineNumbers),
+		chromahtml.BaseLineNumber(opts.LineStart),
+		chromahtml.HighlightLines(highlight),
+	)
+
+	return formatter.Format(w, styles.Fallback, iterator)
+}
+
+// highlightClasses matches the class attribute of every span the highlighter produces
+var highlightClasses = func() *regexp.Regexp {
+	classes := []string{"line hl"}
+	for _, class := range chroma.StandardTypes {
+		if class != "" {
+			classes = append(classes, regexp.QuoteMeta(class))
+		}
+	}
+	return regexp.MustCompile("^(" + strings.Join(classes, "|") + ")$")
+}()
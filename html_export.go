@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// exportImageExtensions are the file extensions images are given in exports, by content type
+var exportImageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// exportedImage is an image attachment packaged with an export that is read offline
+type exportedImage struct {
+	// Path is where the rendered notes expect the image, relative to them
+	Path        string
+	ContentType string
+	Data        []byte
+}
+
+// getSelectedNotes returns the notes picked for an export by the "id" query parameters, in the order given,
+// followed by the user's own notes with the tag in the "tag" query parameter, oldest first.
+// Notes the user can't view are left out.
+func (app *App) getSelectedNotes(r *http.Request, userID int) []Note {
+	var ids []int
+	for _, value := range r.URL.Query()["id"] {
+		id, err := strconv.Atoi(value)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	if tag := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag"))); tag != "" {
+		rows, err := app.db.Query("SELECT id FROM notes WHERE user_id = $1 AND $2 = ANY(tags) ORDER BY created_at, id", userID, tag)
+		if err != nil {
+			app.log.Println("Error getting notes by tag: ", err.Error())
+		} else {
+			defer rows.Close()
+			for rows.Next() {
+				var id int
+				rows.Scan(&id)
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	var notes []Note
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		note := app.getNoteByID(id, userID)
+		if note.ID != 0 {
+			notes = append(notes, note)
+		}
+	}
+
+	return notes
+}
+
+// exportTitle names an export of the selected notes after the note if there is only one, or else the tag they were selected by
+func exportTitle(r *http.Request, notes []Note) string {
+	if len(notes) == 1 {
+		return notes[0].Title
+	}
+	if tag := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag"))); tag != "" {
+		return "#" + tag
+	}
+	return "Notes"
+}
+
+// renderExportNotes renders notes through the same pipeline as the note view, for exports that are read offline.
+// Image attachments are pointed at paths under attachments/ and returned for the export to package, links to
+// other attachments use their signed URLs so they work without logging in.
+func (app *App) renderExportNotes(notes []Note, userID int, base string) ([]Note, []exportedImage) {
+	var images []exportedImage
+	packaged := make(map[int]string)
+
+	for i, note := range notes {
+		opts := app.getMarkdownOptions(userID)
+		opts.Attachments = &attachmentLinks{urls: make(map[int]string)}
+
+		attachments, err := app.getReferencedAttachments(note.Content, note.UserID)
+		if err != nil {
+			app.log.Println("Error resolving attachments for export: ", err.Error())
+		} else {
+			for _, attachment := range attachments {
+				opts.Attachments.urls[attachment.ID] = base + attachmentURL(attachment.ID, exportAttachmentAccess())
+				if !attachment.IsImage() {
+					continue
+				}
+				if path, ok := packaged[attachment.ID]; ok {
+					opts.Attachments.urls[attachment.ID] = path
+					continue
+				}
+
+				data, contentType, err := app.readImage(attachment, imageVariantWidths[len(imageVariantWidths)-1])
+				if err != nil {
+					app.log.Println("Error reading image for export: ", err.Error())
+					continue
+				}
+				path := fmt.Sprintf("attachments/%d%s", attachment.ID, exportImageExtensions[contentType])
+				images = append(images, exportedImage{Path: path, ContentType: contentType, Data: data})
+				packaged[attachment.ID] = path
+				opts.Attachments.urls[attachment.ID] = path
+			}
+		}
+
+		content, toc := app.renderMarkdown(noteSource(note.ID), note.Content, opts)
+		notes[i].ContentHTML, notes[i].TOC = template.HTML(content), template.HTML(toc)
+	}
+
+	return notes, images
+}
+
+// readStylesheets concatenates stylesheets from static/css, so exports can carry them inline
+func readStylesheets(names ...string) (string, error) {
+	var css strings.Builder
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join("static", "css", name))
+		if err != nil {
+			return "", err
+		}
+		css.Write(data)
+		css.WriteString("\n")
+	}
+	return css.String(), nil
+}
+
+// writeStandaloneHTML writes notes as a single HTML file that works offline, with the stylesheets inlined and
+// images embedded as data URIs
+func (app *App) writeStandaloneHTML(out io.Writer, title string, notes []Note, images []exportedImage) error {
+	css, err := readStylesheets("tailwind.css", "styles.css", "highlight-light.css")
+	if err != nil {
+		return err
+	}
+	dark, err := readStylesheets("highlight-dark.css")
+	if err != nil {
+		return err
+	}
+	css += "@media (prefers-color-scheme: dark) {\n" + dark + "}\n"
+
+	var buff bytes.Buffer
+	err = app.templates.ExecuteTemplate(&buff, "standalone_html", struct {
+		Title string
+		CSS   template.CSS
+		Notes []Note
+	}{title, template.CSS(css), notes})
+	if err != nil {
+		return err
+	}
+
+	//The sanitizer doesn't let data URIs through, so they replace the image paths once the notes are rendered
+	page := buff.String()
+	for _, image := range images {
+		dataURI := "data:" + image.ContentType + ";base64," + base64.StdEncoding.EncodeToString(image.Data)
+		page = strings.ReplaceAll(page, `"`+image.Path+`"`, `"`+dataURI+`"`)
+	}
+
+	_, err = io.WriteString(out, page)
+	return err
+}
+
+// handleExportHTML sends the selected notes as a standalone HTML file
+func (app *App) handleExportHTML(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	notes := app.getSelectedNotes(r, userID)
+	if len(notes) == 0 {
+		http.Error(w, "No notes selected", http.StatusBadRequest)
+		return
+	}
+	title := exportTitle(r, notes)
+	notes, images := app.renderExportNotes(notes, userID, baseURL(r))
+
+	err := app.sendArchive(w, r, slugify(title)+".html", "text/html; charset=utf-8", func(out io.Writer) error {
+		return app.writeStandaloneHTML(out, title, notes, images)
+	})
+	if err != nil {
+		app.log.Println("Error exporting notes as HTML: ", err.Error())
+	}
+}
+
+// handleGetExportSelection renders the form for picking the notes to export as HTML or EPUB
+func (app *App) handleGetExportSelection(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	err := app.templates.ExecuteTemplate(w, "export_selection", app.getAllNotes(userID))
+	if err != nil {
+		app.log.Println("Error executing export_selection template: ", err.Error())
+	}
+}
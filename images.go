@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/gomarkdown/markdown/html"
+	"golang.org/x/image/draw"
+	"golang.org/x/sync/singleflight"
+)
+
+// thumbnailWidth is the width of the previews in the attachments panel
+const thumbnailWidth = 160
+
+// imageVariantWidths are the widths, in pixels, of the variants listed in the srcset of image attachments
+var imageVariantWidths = []int{480, 960, 1600}
+
+// maxImagePixels is the largest image, in pixels, variants are generated for. Larger images are served as uploaded,
+// since decoding them could take more memory than the server has.
+const maxImagePixels = 50_000_000
+
+// variantContentTypes are the types of image attachment variants can be generated for
+var variantContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// variantExtensions are the file extensions of the types variants are encoded as
+var variantExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// errNoImageVariant is returned for images variants aren't generated for, which are served as uploaded instead
+var errNoImageVariant = errors.New("no variant for this image")
+
+// imageVariantGroup makes sure the same variant isn't generated twice when several viewers request it at once
+var imageVariantGroup singleflight.Group
+
+// imageVariantSlots bounds how many images are decoded and resized at once, so a page full of new images can't
+// hog every CPU. Reading and storing the images doesn't take a slot.
+var imageVariantSlots = make(chan struct{}, max(1, runtime.NumCPU()/2))
+
+// imageVariant is a resized copy of an image attachment
+type imageVariant struct {
+	Key         string
+	ContentType string
+	Size        int64
+}
+
+// validVariantWidth reports whether variants of the given width are generated
+func validVariantWidth(width int) bool {
+	if width == thumbnailWidth {
+		return true
+	}
+	for _, variantWidth := range imageVariantWidths {
+		if width == variantWidth {
+			return true
+		}
+	}
+	return false
+}
+
+// variantKey returns the blob key of the variant of the image with the given hash
+func variantKey(hash string, width int) string {
+	return fmt.Sprintf("%s-w%d", hash, width)
+}
+
+// attachmentVariantURL returns the address the variant of an image attachment with the given width is served from
+func attachmentVariantURL(id, width int, access attachmentAccess) string {
+	link := attachmentURL(id, access)
+	if strings.Contains(link, "?") {
+		return fmt.Sprintf("%s&w=%d", link, width)
+	}
+	return fmt.Sprintf("%s?w=%d", link, width)
+}
+
+// imageSizes tells browsers how wide images are displayed, matching the width of the note content column
+const imageSizes = "(min-width: 1024px) 50vw, 75vw"
+
+// imageSrcsetPattern matches the srcset attributes of image attachments, so the sanitizer only lets through
+// srcsets pointing at attachment variants
+var imageSrcsetPattern = regexp.MustCompile(`^/api/attachments/[0-9]+\?(exp=[0-9]+&(scope=[a-z0-9-]+&)?sig=[0-9a-f]+&)?w=[0-9]+ [0-9]+w(, /api/attachments/[0-9]+\?(exp=[0-9]+&(scope=[a-z0-9-]+&)?sig=[0-9a-f]+&)?w=[0-9]+ [0-9]+w)*$`)
+
+// imageSrcset lists the variants of an image attachment for the srcset attribute, with the width each one
+// really has. Variants are never wider than the original, so for small images several widths are the same
+// image and only the first is listed. If the size of the original isn't known every width is listed.
+func imageSrcset(id, width int, access attachmentAccess) string {
+	var entries []string
+	for _, variantWidth := range imageVariantWidths {
+		actual := variantWidth
+		if width > 0 && width <= variantWidth {
+			actual = width
+		}
+		entries = append(entries, fmt.Sprintf("%s %dw", attachmentVariantURL(id, variantWidth, access), actual))
+		if actual == width {
+			break
+		}
+	}
+	return strings.Join(entries, ", ")
+}
+
+// renderImage writes an image attachment as a lazily loaded responsive image
+func renderImage(w io.Writer, image attachmentImage, alt, title string) {
+	io.WriteString(w, `<img src="`)
+	html.EscapeHTML(w, []byte(image.Src))
+	io.WriteString(w, `" srcset="`)
+	html.EscapeHTML(w, []byte(image.Srcset))
+	fmt.Fprintf(w, `" sizes="%s" alt="`, imageSizes)
+	html.EscapeHTML(w, []byte(alt))
+	io.WriteString(w, `"`)
+	if title != "" {
+		io.WriteString(w, ` title="`)
+		html.EscapeHTML(w, []byte(title))
+		io.WriteString(w, `"`)
+	}
+	if image.Width > 0 && image.Height > 0 {
+		fmt.Fprintf(w, ` width="%d" height="%d"`, image.Width, image.Height)
+	}
+	io.WriteString(w, ` loading="lazy">`)
+}
+
+// getImageVariant returns the variant of an image attachment with the given width, generating and storing it
+// the first time it is requested. Attachments variants aren't generated for return errNoImageVariant.
+func (app *App) getImageVariant(attachment Attachment, width int) (imageVariant, error) {
+	if !variantContentTypes[attachment.ContentType] {
+		return imageVariant{}, errNoImageVariant
+	}
+
+	variant, err := app.findImageVariant(attachment.Hash, width)
+	if err == nil {
+		return variant, nil
+	}
+
+	generated, err, _ := imageVariantGroup.Do(variantKey(attachment.Hash, width), func() (any, error) {
+		//Another request may have generated it since this one looked
+		variant, err := app.findImageVariant(attachment.Hash, width)
+		if err == nil {
+			return variant, nil
+		}
+		return app.generateImageVariant(attachment, width)
+	})
+	if err != nil {
+		return imageVariant{}, err
+	}
+	return generated.(imageVariant), nil
+}
+
+// generateImageVariant resizes an image attachment to the given width and stores the result as its variant
+func (app *App) generateImageVariant(attachment Attachment, width int) (imageVariant, error) {
+	original, err := app.blobs.get(attachment.Hash)
+	if err != nil {
+		return imageVariant{}, err
+	}
+	data, err := io.ReadAll(original)
+	original.Close()
+	if err != nil {
+		return imageVariant{}, err
+	}
+
+	var buff bytes.Buffer
+	imageVariantSlots <- struct{}{}
+	contentType, originalWidth, originalHeight, err := resizeImage(&buff, bytes.NewReader(data), width)
+	<-imageVariantSlots
+	if err != nil {
+		return imageVariant{}, err
+	}
+
+	variant := imageVariant{
+		Key:         variantKey(attachment.Hash, width),
+		ContentType: contentType,
+		Size:        int64(buff.Len()),
+	}
+	err = app.blobs.put(variant.Key, bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		return imageVariant{}, err
+	}
+
+	_, err = app.db.Exec(`INSERT INTO image_variants(hash, width, content_type, size) VALUES($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`, attachment.Hash, width, variant.ContentType, variant.Size)
+	if err != nil {
+		return imageVariant{}, err
+	}
+
+	//Attachments uploaded before sizes were recorded get them now, so their srcset can be trimmed
+	_, err = app.db.Exec("UPDATE attachments SET width = $1, height = $2 WHERE hash = $3 AND width = 0", originalWidth, originalHeight, attachment.Hash)
+	if err != nil {
+		app.log.Println("Error recording image size: ", err.Error())
+	}
+
+	return variant, nil
+}
+
+// readImage returns the data and content type of the variant of an image attachment with the given width,
+// or of the original if no variant can be generated for it. It is used to embed images in exports.
+func (app *App) readImage(attachment Attachment, width int) ([]byte, string, error) {
+	key, contentType := attachment.Hash, attachment.ContentType
+	variant, err := app.getImageVariant(attachment, width)
+	if err == nil {
+		key, contentType = variant.Key, variant.ContentType
+	}
+
+	blob, err := app.blobs.get(key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer blob.Close()
+
+	data, err := io.ReadAll(blob)
+	return data, contentType, err
+}
+
+// findImageVariant looks up a variant that has already been generated
+func (app *App) findImageVariant(hash string, width int) (imageVariant, error) {
+	variant := imageVariant{Key: variantKey(hash, width)}
+	err := app.db.QueryRow("SELECT content_type, size FROM image_variants WHERE hash = $1 AND width = $2", hash, width).Scan(&variant.ContentType, &variant.Size)
+	return variant, err
+}
+
+// deleteImageVariants deletes every variant generated from the image with the given hash
+func (app *App) deleteImageVariants(hash string) error {
+	rows, err := app.db.Query("SELECT width FROM image_variants WHERE hash = $1", hash)
+	if err != nil {
+		return err
+	}
+	var widths []int
+	for rows.Next() {
+		var width int
+		rows.Scan(&width)
+		widths = append(widths, width)
+	}
+	rows.Close()
+
+	for _, width := range widths {
+		err = app.blobs.delete(variantKey(hash, width))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = app.db.Exec("DELETE FROM image_variants WHERE hash = $1", hash)
+	return err
+}
+
+// imageSize returns the width and height an image is displayed at, after applying its EXIF orientation.
+// It returns zeros for files that aren't images variants can be generated for.
+func imageSize(contents io.ReadSeeker) (int, int) {
+	head := make([]byte, 256<<10)
+	n, _ := io.ReadFull(contents, head)
+	head = head[:n]
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return 0, 0
+	}
+	if exifOrientation(head) >= 5 {
+		return config.Height, config.Width
+	}
+	return config.Width, config.Height
+}
+
+// resizeImage scales an image down to the given width, keeping its aspect ratio, and writes it to w.
+// Images narrower than the width keep their size. The EXIF orientation is applied and all metadata is dropped
+// by decoding and encoding the image again. JPEGs stay JPEGs and everything else becomes a PNG. It returns the
+// content type written and the size of the original after orientation.
+func resizeImage(w io.Writer, r io.Reader, width int) (string, int, int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", 0, 0, errNoImageVariant
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return "", 0, 0, errNoImageVariant
+	}
+
+	//Resizing would lose the animation, so animated GIFs are served as uploaded
+	if format == "gif" {
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil || len(animation.Image) > 1 {
+			return "", 0, 0, errNoImageVariant
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", 0, 0, errNoImageVariant
+	}
+	img = orientImage(img, exifOrientation(data))
+
+	bounds := img.Bounds()
+	if bounds.Dx() > width {
+		height := max(1, (bounds.Dy()*width+bounds.Dx()/2)/bounds.Dx())
+		scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+
+	if format == "jpeg" {
+		return "image/jpeg", bounds.Dx(), bounds.Dy(), jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	}
+	return "image/png", bounds.Dx(), bounds.Dy(), png.Encode(w, img)
+}
+
+// exifOrientation reads the orientation tag from the EXIF data of a JPEG, returning 1, the normal orientation,
+// if there is none. Orientations 5 to 8 are rotated by 90 degrees, so the width and height swap.
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	//Walk the segments of the JPEG up to the start of the image data, looking for the EXIF segment
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return 1
+		}
+
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+
+	return 1
+}
+
+// stripImageMetadata removes the metadata of JPEG and PNG images that can tell where and with what they were
+// taken, like EXIF with its GPS coordinates, XMP, IPTC, comments and text chunks, so originals don't give it away
+// when they're downloaded. Variants drop all metadata anyway. The EXIF orientation of a JPEG is kept, in an EXIF
+// segment of its own, since the image would be shown rotated without it. Anything else is returned unchanged.
+func stripImageMetadata(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xFF\xD8")):
+		return stripJPEGMetadata(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNGMetadata(data)
+	}
+	return data
+}
+
+// stripJPEGMetadata drops the APP1 (EXIF and XMP), APP13 (IPTC) and comment segments of a JPEG. Color profiles
+// and the rest of the segments stay. Malformed JPEGs are returned unchanged.
+func stripJPEGMetadata(data []byte) []byte {
+	var out bytes.Buffer
+	out.Write(data[:2])
+
+	for i := 2; ; {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return data
+		}
+		marker := data[i+1]
+		if marker == 0xDA {
+			//The image data follows the start of scan, up to the end of the file
+			out.Write(data[i:])
+			return out.Bytes()
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return data
+		}
+
+		segment := data[i+4 : i+2+length]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			if orientation := tiffOrientation(segment[6:]); orientation > 1 {
+				out.Write(orientationSegment(orientation))
+			}
+		case marker == 0xE1 || marker == 0xED || marker == 0xFE:
+		default:
+			out.Write(data[i : i+2+length])
+		}
+		i += 2 + length
+	}
+}
+
+// orientationSegment returns a JPEG APP1 segment with EXIF data that holds nothing but the orientation
+func orientationSegment(orientation int) []byte {
+	segment := []byte("\xFF\xE1\x00\x22Exif\x00\x00")
+	//A big endian TIFF header pointing at a directory with a single entry, the orientation as a SHORT
+	segment = append(segment, "MM\x00\x2A\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01"...)
+	segment = binary.BigEndian.AppendUint16(segment, uint16(orientation))
+	return append(segment, 0, 0, 0, 0, 0, 0)
+}
+
+// stripPNGMetadata drops the eXIf and text chunks of a PNG. Malformed PNGs are returned unchanged.
+func stripPNGMetadata(data []byte) []byte {
+	var out bytes.Buffer
+	out.Write(data[:8])
+
+	for i := 8; i < len(data); {
+		if i+12 > len(data) {
+			return data
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return data
+		}
+
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	return out.Bytes()
+}
+
+// tiffOrientation reads the orientation tag from the first directory of the TIFF structure EXIF data is kept in
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+
+	return 1
+}
+
+// orientImage flips and rotates an image so it is displayed upright, according to its EXIF orientation
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if orientation >= 5 {
+		width, height = height, width
+	}
+
+	oriented := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			//Where the pixel at (x, y) of the stored image ends up
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = width-1-y, x
+			case 7:
+				dx, dy = width-1-y, height-1-x
+			case 8:
+				dx, dy = y, height-1-x
+			}
+			oriented.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return oriented
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage returns a 4 by 2 image
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		img.Set(x, 0, color.NRGBA{255, 0, 0, 255})
+		img.Set(x, 1, color.NRGBA{0, 0, 255, 255})
+	}
+	return img
+}
+
+// jpegSegment returns a JPEG segment with the given marker and contents
+func jpegSegment(marker byte, contents []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(contents)+2))
+	return append(segment, contents...)
+}
+
+// pngChunk returns a PNG chunk of the given type. The CRC isn't checked by anything the tests use, so it's left zero.
+func pngChunk(chunkType string, contents []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(contents)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, contents...)
+	return append(chunk, 0, 0, 0, 0)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	var buff bytes.Buffer
+	err := jpeg.Encode(&buff, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := buff.Bytes()
+
+	//EXIF with the orientation followed by a GPS tag, as phones write it, an XMP packet and a comment
+	exif := []byte("Exif\x00\x00II\x2A\x00\x08\x00\x00\x00\x02\x00")
+	exif = append(exif, 0x12, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00)
+	exif = append(exif, 0x25, 0x88, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x26, 0x00, 0x00, 0x00)
+	exif = append(exif, "\x00\x00\x00\x00GPS 52.5200 N 13.4050 E"...)
+	var data []byte
+	data = append(data, encoded[:2]...)
+	data = append(data, jpegSegment(0xE1, exif)...)
+	data = append(data, jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPS</x:xmpmeta>"))...)
+	data = append(data, jpegSegment(0xFE, []byte("GPS comment"))...)
+	data = append(data, encoded[2:]...)
+
+	stripped := stripImageMetadata(data)
+	if bytes.Contains(stripped, []byte("GPS")) {
+		t.Error("the stripped JPEG still contains the metadata")
+	}
+	if orientation := exifOrientation(stripped); orientation != 6 {
+		t.Errorf("the stripped JPEG has orientation %d, want 6", orientation)
+	}
+	if width, height := imageSize(bytes.NewReader(stripped)); width != 2 || height != 4 {
+		t.Errorf("the stripped JPEG is shown %dx%d, want 2x4", width, height)
+	}
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Errorf("the stripped JPEG doesn't decode: %v", err)
+	}
+
+	//Without an orientation no EXIF is left at all, and JPEGs without metadata stay the same
+	if stripped := stripImageMetadata(encoded); !bytes.Equal(stripped, encoded) {
+		t.Error("stripping a JPEG without metadata changed it")
+	}
+
+	truncated := data[:10]
+	if stripped := stripImageMetadata(truncated); !bytes.Equal(stripped, truncated) {
+		t.Error("stripping a malformed JPEG changed it")
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var buff bytes.Buffer
+	err := png.Encode(&buff, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := buff.Bytes()
+
+	//Text chunks go before the image data, right after the 8 byte signature and the 25 byte header chunk
+	var data []byte
+	data = append(data, encoded[:33]...)
+	data = append(data, pngChunk("tEXt", []byte("Comment\x00GPS"))...)
+	data = append(data, pngChunk("eXIf", []byte("MM\x00\x2AGPS"))...)
+	data = append(data, encoded[33:]...)
+
+	stripped := stripImageMetadata(data)
+	if !bytes.Equal(stripped, encoded) {
+		t.Error("the stripped PNG isn't the PNG without its metadata")
+	}
+
+	other := []byte("GIF89a GPS")
+	if stripped := stripImageMetadata(other); !bytes.Equal(stripped, other) {
+		t.Error("stripping changed a file that isn't a JPEG or PNG")
+	}
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// Statuses of an import job
+const (
+	importRunning = "running"
+	importDone    = "done"
+	importFailed  = "failed"
+)
+
+// Formats of files that can be imported
+const (
+	importMarkdown = "markdown"
+	importENEX     = "enex"
+)
+
+// defaultMaxImportMB is the largest zip archive accepted for import, in megabytes, when GONOTE_MAX_IMPORT_MB is not set
+const defaultMaxImportMB = 100
+
+type ImportJob struct {
+	ID        int
+	UserID    int
+	Status    string
+	Total     int
+	Processed int
+	// Error is set if the whole import failed, rather than single files
+	Error   string
+	Results []ImportResult
+}
+
+// ImportResult is the outcome of importing a single Markdown file
+type ImportResult struct {
+	Filename string
+	// NoteID is the note the file was imported as, or 0 if it couldn't be imported
+	NoteID int
+	// Error explains why the file couldn't be imported, or what went wrong importing its attachments
+	Error string
+}
+
+// Running reports whether the job is still importing files
+func (j ImportJob) Running() bool {
+	return j.Status == importRunning
+}
+
+// Imported returns the number of files imported as notes
+func (j ImportJob) Imported() int {
+	imported := 0
+	for _, result := range j.Results {
+		if result.NoteID != 0 {
+			imported++
+		}
+	}
+	return imported
+}
+
+// importedNote is a Markdown file read from an import archive
+type importedNote struct {
+	Path      string
+	Title     string
+	Content   string
+	Tags      []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+var (
+	// obsidianLink matches an Obsidian [[link]] or ![[embed]], with an optional #heading or ^block and |alias
+	obsidianLink = regexp.MustCompile(`(!?)\[\[([^\[\]|#^\n]*)(?:[#^][^\[\]|\n]*)?(?:\|([^\[\]\n]*))?\]\]`)
+	// markdownFileLink matches a regular Markdown link or image with a relative destination
+	markdownFileLink = regexp.MustCompile(`(!?)\[([^\[\]\n]*)\]\(<?([^()<>\s]+)>?(?:\s+"[^"\n]*")?\)`)
+	// frontMatterDate lists the date formats accepted in front matter
+	frontMatterDates = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", time.DateOnly}
+)
+
+// maxImportSize reads the largest accepted import archive from the GONOTE_MAX_IMPORT_MB environment variable, in bytes
+func maxImportSize() int64 {
+	mb, err := strconv.Atoi(os.Getenv("GONOTE_MAX_IMPORT_MB"))
+	if err != nil || mb <= 0 {
+		mb = defaultMaxImportMB
+	}
+	return int64(mb) << 20
+}
+
+// importRouter returns a router with the handlers for the "/import" path
+func (app *App) importRouter() *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Get("/", app.handleGetImport)
+	router.Post("/", app.handleStartImport)
+	router.Get("/{id}", app.handleGetImportJob)
+
+	return router
+}
+
+// ignoredImportPath reports whether a file in an import archive is metadata of another tool rather than a note,
+// like the .obsidian settings directory or the resource forks macOS adds to zip archives
+func ignoredImportPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFrontMatter reads the YAML front matter at the start of a Markdown file into note, and returns the rest of
+// the file. Only the keys gonote has a use for are read, everything else in the front matter is dropped.
+func parseFrontMatter(md string, note *importedNote) string {
+	md = strings.TrimPrefix(md, "\ufeff")
+	if !strings.HasPrefix(md, "---\n") && !strings.HasPrefix(md, "---\r\n") {
+		return md
+	}
+
+	lines := strings.Split(md, "\n")
+	end := -1
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if line == "---" || line == "..." {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return md
+	}
+
+	key := ""
+	for _, line := range lines[1:end] {
+		line = strings.TrimRight(line, "\r")
+
+		//Items of a block list belong to the key before them
+		if item, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok && key != "" {
+			if key == "tags" || key == "tag" {
+				note.Tags = append(note.Tags, yamlScalar(item))
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.HasPrefix(line, " ") {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "title":
+			note.Title = yamlScalar(value)
+		case "created", "created_at", "date":
+			if date, ok := parseFrontMatterDate(yamlScalar(value)); ok {
+				note.CreatedAt = date
+			}
+		case "updated", "updated_at", "modified":
+			if date, ok := parseFrontMatterDate(yamlScalar(value)); ok {
+				note.UpdatedAt = date
+			}
+		case "tags", "tag":
+			value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+			for _, tag := range strings.Split(value, ",") {
+				if tag = yamlScalar(tag); tag != "" {
+					note.Tags = append(note.Tags, tag)
+				}
+			}
+		}
+	}
+
+	for i, tag := range note.Tags {
+		note.Tags[i] = strings.TrimPrefix(tag, "#")
+	}
+
+	return strings.TrimLeft(strings.Join(lines[end+1:], "\n"), "\r\n")
+}
+
+// yamlScalar returns the value of a plain or quoted YAML scalar
+func yamlScalar(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		unquoted, err := strconv.Unquote(value)
+		if err == nil {
+			return unquoted
+		}
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+// parseFrontMatterDate parses a date or timestamp in one of the formats of frontMatterDates
+func parseFrontMatterDate(value string) (time.Time, bool) {
+	for _, layout := range frontMatterDates {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// noteTitleKey returns the name other files link to a Markdown file by: its file name without the extension, ignoring case
+func noteTitleKey(name string) string {
+	return wikiLinkKey(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+}
+
+// convertObsidianLinks rewrites the links of an imported Markdown file for gonote. Links to other files in the
+// import become [[wiki links]] to the titles they were imported with, and embedded files become attachments.
+// attach returns the attachment:ID reference of a file a link points to, relative to the file being converted,
+// or false if there is no such file. Fenced code blocks are left alone.
+func convertObsidianLinks(md string, titles map[string]string, attach func(target string) (string, bool)) string {
+	title := func(target string) string {
+		if title, ok := titles[noteTitleKey(target)]; ok {
+			return title
+		}
+		return strings.TrimSuffix(path.Base(target), ".md")
+	}
+
+	lines := strings.Split(md, "\n")
+	fence := ""
+	for i, line := range lines {
+		if match := fenceLine.FindStringSubmatch(line); match != nil {
+			if fence == "" {
+				fence = match[1]
+			} else if match[1] == fence {
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+
+		line = obsidianLink.ReplaceAllStringFunc(line, func(link string) string {
+			match := obsidianLink.FindStringSubmatch(link)
+			embed, target, alias := match[1] == "!", strings.TrimSpace(match[2]), strings.TrimSpace(match[3])
+			if target == "" {
+				return link
+			}
+
+			if embed && !strings.EqualFold(path.Ext(target), ".md") {
+				if reference, ok := attach(target); ok {
+					//Obsidian uses the alias of embedded images for their size, which gonote has no use for
+					return fmt.Sprintf("![%s](%s)", path.Base(target), reference)
+				}
+			}
+
+			if alias != "" {
+				return "[[" + title(target) + "|" + alias + "]]"
+			}
+			return "[[" + title(target) + "]]"
+		})
+
+		line = markdownFileLink.ReplaceAllStringFunc(line, func(link string) string {
+			match := markdownFileLink.FindStringSubmatch(link)
+			image, text, destination := match[1] == "!", match[2], match[3]
+			if strings.Contains(destination, ":") || strings.HasPrefix(destination, "#") {
+				return link
+			}
+			target, err := url.PathUnescape(destination)
+			if err != nil {
+				target = destination
+			}
+
+			if strings.EqualFold(path.Ext(target), ".md") && !image {
+				if text == "" {
+					return "[[" + title(target) + "]]"
+				}
+				return "[[" + title(target) + "|" + text + "]]"
+			}
+			if reference, ok := attach(target); ok {
+				return fmt.Sprintf("%s[%s](%s)", match[1], text, reference)
+			}
+			return link
+		})
+
+		lines[i] = line
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// importArchive indexes the files of an import archive so links between them can be resolved
+type importArchive struct {
+	// files maps the lowercase path of every file to it
+	files map[string]*zip.File
+	// names maps lowercase file names to the files with that name, for links that only give the name
+	names map[string][]*zip.File
+}
+
+func newImportArchive(zr *zip.Reader) importArchive {
+	archive := importArchive{files: make(map[string]*zip.File), names: make(map[string][]*zip.File)}
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() || ignoredImportPath(file.Name) {
+			continue
+		}
+		name := strings.ToLower(path.Clean(file.Name))
+		archive.files[name] = file
+		archive.names[path.Base(name)] = append(archive.names[path.Base(name)], file)
+	}
+	return archive
+}
+
+// resolve finds the file a link in the Markdown file at from points to. Like Obsidian, links are tried relative
+// to the file, then relative to the root of the archive and finally by file name alone.
+func (a importArchive) resolve(from, target string) *zip.File {
+	target = strings.ToLower(strings.TrimPrefix(target, "/"))
+	for _, candidate := range []string{path.Join(path.Dir(strings.ToLower(from)), target), path.Clean(target)} {
+		if file, ok := a.files[candidate]; ok {
+			return file
+		}
+	}
+	if files := a.names[path.Base(target)]; len(files) > 0 {
+		return files[0]
+	}
+	return nil
+}
+
+// readImportFile reads a file from an import archive, refusing files larger than limit
+func readImportFile(file *zip.File, limit int64) ([]byte, error) {
+	if file.UncompressedSize64 > uint64(limit) {
+		return nil, fmt.Errorf("%s is larger than %s", path.Base(file.Name), formatBytes(limit))
+	}
+
+	contents, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer contents.Close()
+
+	//The size in the archive header can't be trusted, so stop reading past the limit as well
+	data, err := io.ReadAll(io.LimitReader(contents, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %s", path.Base(file.Name), formatBytes(limit))
+	}
+	return data, nil
+}
+
+// readImportedNote reads a Markdown file from an import archive. Its title and dates come from its front matter,
+// falling back to its file name and modification time, and the folders it is in become a tag.
+func readImportedNote(file *zip.File) (importedNote, error) {
+	data, err := readImportFile(file, maxNoteBytes)
+	if err != nil {
+		return importedNote{}, err
+	}
+
+	note := importedNote{Path: file.Name}
+	note.Content = parseFrontMatter(string(data), &note)
+	if strings.TrimSpace(note.Title) == "" {
+		note.Title = strings.TrimSuffix(path.Base(file.Name), path.Ext(file.Name))
+	}
+	//Zip archives can't store times before 1980, so earlier modification times mean the archive didn't record one
+	modified := file.Modified
+	if modified.Year() < 1980 {
+		modified = time.Now()
+	}
+	if note.CreatedAt.IsZero() {
+		note.CreatedAt = modified
+	}
+	if note.UpdatedAt.IsZero() {
+		note.UpdatedAt = modified
+	}
+	if note.UpdatedAt.Before(note.CreatedAt) {
+		note.UpdatedAt = note.CreatedAt
+	}
+
+	if folder := path.Dir(file.Name); folder != "." {
+		note.Tags = append(note.Tags, folder)
+	}
+	note.Tags = parseTags(strings.Join(note.Tags, ","))
+
+	return note, nil
+}
+
+// runImport imports every note of an uploaded file for the job's user, recording the outcome of each note as it goes.
+// It is run in the background, and deletes the file when it is done.
+func (app *App) runImport(job ImportJob, uploadPath, format string) {
+	status, message := importDone, ""
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			app.log.Println("Error importing notes: ", recovered)
+			status, message = importFailed, "Internal server error"
+		}
+		os.Remove(uploadPath)
+
+		_, err := app.db.Exec("UPDATE import_jobs SET status = $1, error = $2, finished_at = now() WHERE id = $3", status, message, job.ID)
+		if err != nil {
+			app.log.Println("Error finishing import job: ", err.Error())
+		}
+	}()
+
+	var err error
+	if format == importENEX {
+		err = app.importENEX(job, uploadPath)
+	} else {
+		err = app.importMarkdownArchive(job, uploadPath)
+	}
+	if err != nil {
+		status, message = importFailed, err.Error()
+	}
+}
+
+// importMarkdownArchive imports every Markdown file of a zip archive as a note, attaching the files they embed
+func (app *App) importMarkdownArchive(job ImportJob, archivePath string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return errors.New("The file is not a zip archive")
+	}
+	defer zr.Close()
+	archive := newImportArchive(&zr.Reader)
+
+	//Read every note first, so links can be pointed at the titles notes are imported with
+	var notes []importedNote
+	titles := make(map[string]string)
+	for _, file := range zr.File {
+		if !isImportedNoteFile(file) {
+			continue
+		}
+
+		note, err := readImportedNote(file)
+		if err != nil {
+			app.recordImportResult(job.ID, ImportResult{Filename: file.Name, Error: err.Error()})
+			continue
+		}
+		notes = append(notes, note)
+		titles[noteTitleKey(file.Name)] = note.Title
+	}
+
+	for _, imported := range notes {
+		result := app.importNote(job.UserID, imported, func(note Note) (string, []string) {
+			var problems []string
+			attached := make(map[*zip.File]string)
+
+			content := convertObsidianLinks(imported.Content, titles, func(target string) (string, bool) {
+				file := archive.resolve(imported.Path, target)
+				if file == nil {
+					if path.Ext(target) == "" {
+						return "", false
+					}
+					problems = append(problems, fmt.Sprintf("could not find %s", path.Base(target)))
+					return "", false
+				}
+				if isImportedNoteFile(file) {
+					return "", false
+				}
+				//Files that couldn't be attached are cached as "", so they are only tried and reported once
+				if reference, ok := attached[file]; ok {
+					return reference, reference != ""
+				}
+
+				data, err := readImportFile(file, maxUploadSize())
+				if err == nil {
+					var attachment Attachment
+					attachment, err = app.importAttachment(note, file.Name, data)
+					if err == nil {
+						attached[file] = fmt.Sprintf("attachment:%d", attachment.ID)
+					}
+				}
+				if err != nil {
+					attached[file] = ""
+					problems = append(problems, fmt.Sprintf("could not attach %s: %s", path.Base(file.Name), err.Error()))
+					return "", false
+				}
+				return attached[file], true
+			})
+
+			return content, problems
+		})
+		app.recordImportResult(job.ID, result)
+	}
+
+	return nil
+}
+
+// isImportedNoteFile reports whether a file in an import archive is a Markdown file to import as a note
+func isImportedNoteFile(file *zip.File) bool {
+	return !file.FileInfo().IsDir() && !ignoredImportPath(file.Name) && strings.EqualFold(path.Ext(file.Name), ".md")
+}
+
+// importNote stores an imported note. Once the note exists, convert is called to produce its final content, which
+// can attach files to the note, along with any problems it ran into along the way.
+func (app *App) importNote(userID int, imported importedNote, convert func(note Note) (string, []string)) ImportResult {
+	result := ImportResult{Filename: imported.Path}
+
+	exceeded, err := app.quotaExceeded(userID, Usage{Notes: 1, NoteBytes: int64(len(imported.Title) + len(imported.Content))})
+	if err != nil {
+		app.log.Println("Error checking quota: ", err.Error())
+		result.Error = "Internal server error"
+		return result
+	}
+	if exceeded != "" {
+		result.Error = exceeded
+		return result
+	}
+
+	err = app.db.QueryRow(`INSERT INTO notes(user_id, title, content, tags, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6) RETURNING id`,
+		userID, imported.Title, imported.Content, pq.Array(imported.Tags), imported.CreatedAt, imported.UpdatedAt).Scan(&result.NoteID)
+	if err != nil {
+		app.log.Println("Error importing note: ", err.Error())
+		result.Error = "Internal server error"
+		return result
+	}
+	note := Note{ID: result.NoteID, UserID: userID}
+
+	content, problems := convert(note)
+	if content != imported.Content {
+		_, err = app.db.Exec("UPDATE notes SET content = $1, version = version + 1 WHERE id = $2", content, note.ID)
+		if err != nil {
+			app.log.Println("Error converting imported note: ", err.Error())
+			problems = append(problems, "could not convert its links")
+			content = imported.Content
+		}
+	}
+
+	err = app.saveNoteLinks(note.ID, content)
+	if err != nil {
+		app.log.Println("Error indexing note links: ", err.Error())
+	}
+
+	if len(problems) > 0 {
+		result.Error = "Imported, but " + strings.Join(problems, ", ")
+	}
+	return result
+}
+
+// importAttachment attaches an imported file to an imported note, checking the user's quota first
+func (app *App) importAttachment(note Note, filename string, data []byte) (Attachment, error) {
+	exceeded, err := app.quotaExceeded(note.UserID, Usage{AttachmentBytes: int64(len(data))})
+	if err != nil {
+		return Attachment{}, err
+	}
+	if exceeded != "" {
+		return Attachment{}, errors.New(exceeded)
+	}
+
+	return app.saveAttachment(note, note.UserID, cleanFilename(filename), bytes.NewReader(data))
+}
+
+// recordImportResult stores the outcome of importing a file and counts it towards the job's progress
+func (app *App) recordImportResult(jobID int, result ImportResult) {
+	noteID := &result.NoteID
+	if result.NoteID == 0 {
+		noteID = nil
+	}
+
+	_, err := app.db.Exec("INSERT INTO import_results(job_id, filename, note_id, error) VALUES($1, $2, $3, $4)", jobID, result.Filename, noteID, result.Error)
+	if err != nil {
+		app.log.Println("Error recording import result: ", err.Error())
+	}
+	_, err = app.db.Exec("UPDATE import_jobs SET processed = processed + 1 WHERE id = $1", jobID)
+	if err != nil {
+		app.log.Println("Error recording import progress: ", err.Error())
+	}
+}
+
+// failInterruptedImports marks import jobs that were still running when the server last stopped as failed,
+// since nothing is left to finish them
+func (app *App) failInterruptedImports() {
+	_, err := app.db.Exec("UPDATE import_jobs SET status = $1, error = $2, finished_at = now() WHERE status = $3",
+		importFailed, "The server restarted during the import", importRunning)
+	if err != nil {
+		app.log.Println("Error failing interrupted imports: ", err.Error())
+	}
+}
+
+// getImportJob returns an import job of a user with the results so far. If the user has no job with the ID,
+// the returned ImportJob has an ID of 0.
+func (app *App) getImportJob(id, userID int) ImportJob {
+	var job ImportJob
+	err := app.db.QueryRow("SELECT id, user_id, status, total, processed, error FROM import_jobs WHERE id = $1 AND user_id = $2", id, userID).
+		Scan(&job.ID, &job.UserID, &job.Status, &job.Total, &job.Processed, &job.Error)
+	if err != nil {
+		return ImportJob{}
+	}
+
+	rows, err := app.db.Query("SELECT filename, COALESCE(note_id, 0), error FROM import_results WHERE job_id = $1 ORDER BY id", id)
+	if err != nil {
+		app.log.Println("Error getting import results: ", err.Error())
+		return job
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result ImportResult
+		rows.Scan(&result.Filename, &result.NoteID, &result.Error)
+		job.Results = append(job.Results, result)
+	}
+
+	return job
+}
+
+// getLatestImportJob returns the most recent import job of a user, or an ImportJob with an ID of 0 if there is none
+func (app *App) getLatestImportJob(userID int) ImportJob {
+	var id int
+	err := app.db.QueryRow("SELECT id FROM import_jobs WHERE user_id = $1 ORDER BY id DESC LIMIT 1", userID).Scan(&id)
+	if err != nil {
+		return ImportJob{}
+	}
+	return app.getImportJob(id, userID)
+}
+
+// renderImportJob renders the progress or results of an import job to the ResponseWriter
+func (app *App) renderImportJob(w http.ResponseWriter, job ImportJob) {
+	err := app.templates.ExecuteTemplate(w, "import_job", job)
+	if err != nil {
+		app.log.Println("Error executing import_job template: ", err.Error())
+	}
+}
+
+// handleGetImport renders the import form, along with the latest import job of the logged in user
+func (app *App) handleGetImport(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	err := app.templates.ExecuteTemplate(w, "import", app.getLatestImportJob(userID))
+	if err != nil {
+		app.log.Println("Error executing import template: ", err.Error())
+	}
+}
+
+// handleGetImportJob renders the progress of an import job, for the import panel to poll
+func (app *App) handleGetImportJob(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	job := app.getImportJob(id, userID)
+	if job.ID == 0 {
+		app.sendErrorToastNoSwap(w, "Import not found")
+		return
+	}
+
+	app.renderImportJob(w, job)
+}
+
+// handleStartImport stores the zip archive or ENEX export in the multipart form request and starts importing it in the background
+func (app *App) handleStartImport(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	maxSize := maxImportSize()
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			app.sendErrorToastNoSwap(w, fmt.Sprintf("Imports can be at most %d MB", maxSize>>20))
+			return
+		}
+		app.sendErrorToastNoSwap(w, "No file was uploaded")
+		return
+	}
+	defer upload.Close()
+
+	format := importMarkdown
+	if strings.EqualFold(path.Ext(header.Filename), ".enex") {
+		format = importENEX
+	}
+
+	//Keep the upload on disk for the background job, it is gone once the request ends
+	stored, err := os.CreateTemp("", "gonote-import-*")
+	if err != nil {
+		app.log.Println("Error storing import: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+	size, err := io.Copy(stored, upload)
+	if closeErr := stored.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(stored.Name())
+		app.log.Println("Error storing import: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	var total int
+	if format == importENEX {
+		total, err = countENEXNotes(stored.Name())
+	} else {
+		total, err = countImportedNotes(stored.Name(), size)
+	}
+	if err != nil || total == 0 {
+		os.Remove(stored.Name())
+		switch {
+		case format == importENEX:
+			app.sendErrorToastNoSwap(w, "The file is not an Evernote export, or has no notes in it")
+		case err != nil:
+			app.sendErrorToastNoSwap(w, "The file is not a zip archive")
+		default:
+			app.sendErrorToastNoSwap(w, "The archive has no Markdown files in it")
+		}
+		return
+	}
+
+	job := ImportJob{UserID: userID, Status: importRunning, Total: total}
+	err = app.db.QueryRow("INSERT INTO import_jobs(user_id, status, total) VALUES($1, $2, $3) RETURNING id", userID, job.Status, job.Total).Scan(&job.ID)
+	if err != nil {
+		os.Remove(stored.Name())
+		app.log.Println("Error creating import job: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	go app.runImport(job, stored.Name(), format)
+
+	app.renderImportJob(w, job)
+}
+
+// countImportedNotes opens an import archive and counts the Markdown files in it
+func countImportedNotes(archivePath string, size int64) (int, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, file := range zr.File {
+		if isImportedNoteFile(file) {
+			total++
+		}
+	}
+	return total, nil
+}
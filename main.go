@@ -1,7 +1,20 @@
 package main
 
+import (
+	"log"
+	"os"
+)
+
 //go:generate npm run build
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export-site" {
+		err := exportSiteCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalln("export-site:", err.Error())
+		}
+		return
+	}
+
 	startApp()
 }
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// markdownOptions selects the optional extensions used when rendering Markdown
+type markdownOptions struct {
+	Footnotes       bool
+	DefinitionLists bool
+	TaskLists       bool
+	Admonitions     bool
+	HeadingAnchors  bool
+	SmartTypography bool
+	Emoji           bool
+	Highlighting    bool
+
+	// InteractiveTasks renders task checkboxes enabled and numbered so they can be toggled from the
+	// view mode. It is not an extension users configure, but depends on who is viewing the note.
+	InteractiveTasks bool
+	// WikiLinks resolves [[wiki links]] to the notes they name. Without it, wiki links render as plain text.
+	WikiLinks *wikiLinks
+	// Attachments resolves attachment:ID links and images to the URLs of the files. Unresolved ones are dropped.
+	Attachments *attachmentLinks
+}
+
+// markdownExtensions lists every optional extension by the name used in configuration, in display order
+var markdownExtensions = []struct {
+	Name  string
+	Label string
+}{
+	{"footnotes", "Footnotes"},
+	{"definition_lists", "Definition lists"},
+	{"task_lists", "Task lists"},
+	{"admonitions", "Admonitions (> [!NOTE])"},
+	{"heading_anchors", "Heading anchors"},
+	{"smart_typography", "Smart typography"},
+	{"emoji", "Emoji shortcodes (:smile:)"},
+	{"syntax_highlighting", "Syntax highlighting of code blocks"},
+}
+
+// allMarkdownExtensions is the instance default when GONOTE_MARKDOWN_EXTENSIONS is not set
+const allMarkdownExtensions = "footnotes,definition_lists,task_lists,admonitions,heading_anchors,smart_typography,emoji,syntax_highlighting"
+
+// field returns a pointer to the option with the given configuration name, or nil if there is none
+func (o *markdownOptions) field(name string) *bool {
+	switch name {
+	case "footnotes":
+		return &o.Footnotes
+	case "definition_lists":
+		return &o.DefinitionLists
+	case "task_lists":
+		return &o.TaskLists
+	case "admonitions":
+		return &o.Admonitions
+	case "heading_anchors":
+		return &o.HeadingAnchors
+	case "smart_typography":
+		return &o.SmartTypography
+	case "emoji":
+		return &o.Emoji
+	case "syntax_highlighting":
+		return &o.Highlighting
+	}
+	return nil
+}
+
+// Enabled reports whether the extension with the given configuration name is turned on
+func (o markdownOptions) Enabled(name string) bool {
+	field := o.field(name)
+	return field != nil && *field
+}
+
+// String returns the enabled extensions as a comma separated list, the format parseMarkdownOptions reads
+func (o markdownOptions) String() string {
+	var names []string
+	for _, extension := range markdownExtensions {
+		if o.Enabled(extension.Name) {
+			names = append(names, extension.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseMarkdownOptions turns a comma separated list of extension names into markdownOptions.
+// Unknown names are ignored.
+func parseMarkdownOptions(list string) markdownOptions {
+	var opts markdownOptions
+	for _, name := range strings.Split(list, ",") {
+		field := opts.field(strings.TrimSpace(name))
+		if field != nil {
+			*field = true
+		}
+	}
+	return opts
+}
+
+// markdownPolicy is the sanitizer applied to all rendered Markdown. It extends the UGC policy with
+// exactly the classes and elements the optional extensions produce.
+var markdownPolicy = newMarkdownPolicy()
+
+func newMarkdownPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^(footnotes|footnote-ref|footnote-return)$`)).OnElements("div", "sup", "a")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^admonition( admonition-(note|tip|important|warning|caution))?$|^admonition-title$`)).OnElements("div", "p")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^task-list-item$`)).OnElements("li")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^task-list-item-checkbox$`)).OnElements("input")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^heading-anchor$`)).OnElements("a")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^wiki-link( wiki-link-missing)?$`)).OnElements("a")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^toc$`)).OnElements("div")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^toc-level-[1-6]$`)).OnElements("li")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^chroma$`)).OnElements("pre")
+	policy.AllowAttrs("class").Matching(highlightClasses).OnElements("span")
+
+	policy.AllowAttrs("srcset").Matching(imageSrcsetPattern).OnElements("img")
+	policy.AllowAttrs("sizes").Matching(regexp.MustCompile(`^[a-z0-9(): ,.-]+$`)).OnElements("img")
+	policy.AllowAttrs("loading").Matching(regexp.MustCompile(`^lazy$`)).OnElements("img")
+
+	policy.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	policy.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^(|checked|disabled)$`)).OnElements("input")
+	policy.AllowAttrs("data-task").Matching(regexp.MustCompile(`^[0-9]+$`)).OnElements("input")
+
+	return policy
+}
+
+// admonitionKinds maps the GitHub style admonition markers to their titles
+var admonitionKinds = map[string]string{
+	"note":      "Note",
+	"tip":       "Tip",
+	"important": "Important",
+	"warning":   "Warning",
+	"caution":   "Caution",
+}
+
+var (
+	admonitionMarker = regexp.MustCompile(`^\[!([A-Za-z]+)\][ \t]*\n?`)
+	taskMarker       = regexp.MustCompile(`^\[([ xX])\]\s+`)
+	emojiShortcode   = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+)
+
+// firstText returns the text node at the start of the first paragraph of a block, if there is one
+func firstText(node ast.Node) *ast.Text {
+	paragraph, ok := ast.GetFirstChild(node).(*ast.Paragraph)
+	if !ok {
+		return nil
+	}
+
+	text, _ := ast.GetFirstChild(paragraph).(*ast.Text)
+	return text
+}
+
+// markdownTask is a task list item found while preparing a document
+type markdownTask struct {
+	Index   int
+	Checked bool
+}
+
+// markdownRenderer holds the state of rendering a single document
+type markdownRenderer struct {
+	opts        markdownOptions
+	admonitions map[ast.Node]string
+	tasks       map[ast.Node]markdownTask
+	tocMarkers  map[ast.Node]bool
+	images      map[ast.Node]attachmentImage
+	headings    []tocEntry
+}
+
+// prepare walks the parsed document and rewrites the nodes affected by the enabled extensions
+func (m *markdownRenderer) prepare(doc ast.Node) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+
+		switch node := node.(type) {
+		case *ast.BlockQuote:
+			if m.opts.Admonitions {
+				m.prepareAdmonition(node)
+			}
+		case *ast.ListItem:
+			if m.opts.TaskLists && node.RefLink == nil {
+				m.prepareTask(node)
+			}
+		case *ast.Image:
+			if bytes.HasPrefix(node.Destination, []byte("attachment:")) {
+				if image, ok := m.opts.Attachments.image(string(node.Destination)); ok {
+					m.images[node] = image
+				}
+				node.Destination = []byte(m.opts.Attachments.url(string(node.Destination)))
+			}
+		case *ast.Link:
+			if bytes.HasPrefix(node.Destination, []byte("attachment:")) {
+				node.Destination = []byte(m.opts.Attachments.url(string(node.Destination)))
+			}
+		case *ast.Paragraph:
+			if isTOCMarker(node) {
+				m.tocMarkers[node] = true
+			}
+		case *ast.Text:
+			if m.opts.Emoji {
+				node.Literal = replaceEmoji(node.Literal)
+			}
+		}
+		return ast.GoToNext
+	})
+
+	m.headings = findHeadings(doc)
+}
+
+// prepareAdmonition records a block quote starting with a marker like [!NOTE] as an admonition and removes the marker
+func (m *markdownRenderer) prepareAdmonition(quote *ast.BlockQuote) {
+	text := firstText(quote)
+	if text == nil {
+		return
+	}
+
+	match := admonitionMarker.FindSubmatch(text.Literal)
+	if match == nil {
+		return
+	}
+	kind := strings.ToLower(string(match[1]))
+	if _, ok := admonitionKinds[kind]; !ok {
+		return
+	}
+
+	m.admonitions[quote] = kind
+	text.Literal = text.Literal[len(match[0]):]
+
+	//Drop the paragraph entirely if the marker was all it held
+	paragraph := text.Parent
+	if len(text.Literal) == 0 && len(paragraph.GetChildren()) == 1 {
+		ast.RemoveFromTree(paragraph)
+	}
+}
+
+// prepareTask records a list item starting with [ ] or [x] as a task and removes the marker
+func (m *markdownRenderer) prepareTask(item *ast.ListItem) {
+	text := firstText(item)
+	if text == nil {
+		return
+	}
+
+	match := taskMarker.FindSubmatch(text.Literal)
+	if match == nil {
+		return
+	}
+
+	m.tasks[item] = markdownTask{
+		Index:   len(m.tasks),
+		Checked: match[1][0] != ' ',
+	}
+	text.Literal = text.Literal[len(match[0]):]
+}
+
+// renderHook replaces the HTML of admonitions, tasks, headings, code blocks, image attachments and [TOC] markers,
+// and renders wiki links
+func (m *markdownRenderer) renderHook(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	switch node := node.(type) {
+	case *ast.BlockQuote:
+		kind, ok := m.admonitions[node]
+		if !ok {
+			return ast.GoToNext, false
+		}
+		if entering {
+			fmt.Fprintf(w, "<div class=\"admonition admonition-%s\">\n<p class=\"admonition-title\">%s</p>\n", kind, admonitionKinds[kind])
+		} else {
+			io.WriteString(w, "</div>\n")
+		}
+		return ast.GoToNext, true
+
+	case *ast.ListItem:
+		task, ok := m.tasks[node]
+		if !ok || !entering {
+			return ast.GoToNext, false
+		}
+		io.WriteString(w, "<li class=\"task-list-item\"><input type=\"checkbox\" class=\"task-list-item-checkbox\"")
+		if m.opts.InteractiveTasks {
+			fmt.Fprintf(w, " data-task=\"%d\"", task.Index)
+		} else {
+			io.WriteString(w, " disabled")
+		}
+		if task.Checked {
+			io.WriteString(w, " checked")
+		}
+		io.WriteString(w, "> ")
+		return ast.GoToNext, true
+
+	case *ast.Heading:
+		//Add the anchor just before the closing tag and let the renderer close the heading
+		if m.opts.HeadingAnchors && !entering && node.HeadingID != "" {
+			fmt.Fprintf(w, " <a class=\"heading-anchor\" href=\"#%s\">#</a>", node.HeadingID)
+		}
+		return ast.GoToNext, false
+
+	case *ast.Paragraph:
+		if !m.tocMarkers[node] {
+			return ast.GoToNext, false
+		}
+		if entering {
+			renderTOC(w, m.headings)
+		}
+		return ast.SkipChildren, true
+
+	case *wikiLink:
+		renderWikiLink(w, node, m.opts.WikiLinks)
+		return ast.GoToNext, true
+
+	case *ast.Image:
+		image, ok := m.images[node]
+		if !ok {
+			return ast.GoToNext, false
+		}
+		if entering {
+			renderImage(w, image, plainText(node), string(node.Title))
+		}
+		return ast.SkipChildren, true
+
+	case *ast.CodeBlock:
+		if !m.opts.Highlighting || len(node.Info) == 0 {
+			return ast.GoToNext, false
+		}
+		//Fall back to the plain code block if the highlighter fails
+		var buff bytes.Buffer
+		err := highlightCode(&buff, string(node.Literal), parseCodeBlockInfo(string(node.Info)))
+		if err != nil {
+			return ast.GoToNext, false
+		}
+		buff.WriteString("\n")
+		buff.WriteTo(w)
+		return ast.GoToNext, true
+	}
+
+	return ast.GoToNext, false
+}
+
+// replaceEmoji swaps known :shortcode: sequences for the emoji they name
+func replaceEmoji(text []byte) []byte {
+	if bytes.IndexByte(text, ':') < 0 {
+		return text
+	}
+
+	return emojiShortcode.ReplaceAllFunc(text, func(match []byte) []byte {
+		emoji, ok := emojiShortcodes[string(match[1:len(match)-1])]
+		if !ok {
+			return match
+		}
+		return []byte(emoji)
+	})
+}
+
+// parseMarkdown parses Markdown with the given extensions and prepares the document for rendering
+func parseMarkdown(md string, opts markdownOptions) (ast.Node, *markdownRenderer) {
+	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock
+	if opts.Footnotes {
+		extensions |= parser.Footnotes
+	}
+	if !opts.DefinitionLists {
+		extensions &^= parser.DefinitionLists
+	}
+	p := parser.NewWithExtensions(extensions)
+	registerWikiLinks(p)
+	doc := p.Parse([]byte(normalizeFences(md)))
+
+	m := &markdownRenderer{
+		opts:        opts,
+		admonitions: make(map[ast.Node]string),
+		tasks:       make(map[ast.Node]markdownTask),
+		tocMarkers:  make(map[ast.Node]bool),
+		images:      make(map[ast.Node]attachmentImage),
+	}
+	m.prepare(doc)
+
+	return doc, m
+}
+
+// mdToHTML renders Markdown to sanitized HTML using the given extensions
+func mdToHTML(md string, opts markdownOptions) string {
+	content, _ := mdToHTMLWithTOC(md, opts)
+	return content
+}
+
+// mdToHTMLWithTOC renders Markdown like mdToHTML, and also returns a table of contents of the document.
+// The table of contents is empty unless the document has at least tocMinHeadings headings.
+func mdToHTMLWithTOC(md string, opts markdownOptions) (string, string) {
+	doc, m := parseMarkdown(md, opts)
+
+	htmlFlags := html.HrefTargetBlank
+	if opts.SmartTypography {
+		htmlFlags |= html.CommonFlags
+	}
+	if opts.Footnotes {
+		htmlFlags |= html.FootnoteReturnLinks
+	}
+	renderer := html.NewRenderer(html.RendererOptions{
+		Flags:          htmlFlags,
+		RenderNodeHook: m.renderHook,
+	})
+
+	unsafeHTMLDoc := markdown.Render(doc, renderer)
+	safeHTML := markdownPolicy.SanitizeBytes(unsafeHTMLDoc)
+
+	if len(m.headings) < tocMinHeadings {
+		return string(safeHTML), ""
+	}
+	var toc bytes.Buffer
+	renderTOC(&toc, m.headings)
+
+	return string(safeHTML), markdownPolicy.Sanitize(toc.String())
+}
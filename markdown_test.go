@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests with the current output")
+
+// extensionMarkers lists for every extension a piece of HTML only the extension produces, so the tests notice
+// when the sanitizer starts stripping what an extension renders
+var extensionMarkers = map[string]string{
+	"footnotes":           `<div class="footnotes">`,
+	"definition_lists":    `<dl>`,
+	"task_lists":          `class="task-list-item-checkbox"`,
+	"admonitions":         `class="admonition admonition-note"`,
+	"heading_anchors":     `class="heading-anchor"`,
+	"smart_typography":    "“",
+	"emoji":               "🎉",
+	"syntax_highlighting": `<pre class="chroma">`,
+}
+
+// checkGolden compares output to the golden file at path, or rewrites the file with -update
+func checkGolden(t *testing.T, path, output string) {
+	t.Helper()
+	if *update {
+		err := os.WriteFile(path, []byte(output), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != string(golden) {
+		t.Errorf("output doesn't match %s\ngot:\n%s\nwant:\n%s", path, output, golden)
+	}
+}
+
+// TestMarkdownExtensions renders testdata/render/<extension>.md with only that extension turned on and with
+// every extension turned off, and compares the HTML to <extension>.on.golden.html and <extension>.off.golden.html
+func TestMarkdownExtensions(t *testing.T) {
+	for _, extension := range markdownExtensions {
+		t.Run(extension.Name, func(t *testing.T) {
+			base := filepath.Join("testdata", "render", extension.Name)
+			md, err := os.ReadFile(base + ".md")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			on := mdToHTML(string(md), parseMarkdownOptions(extension.Name))
+			off := mdToHTML(string(md), parseMarkdownOptions(""))
+			checkGolden(t, base+".on.golden.html", on)
+			checkGolden(t, base+".off.golden.html", off)
+
+			marker := extensionMarkers[extension.Name]
+			if marker == "" {
+				t.Fatalf("no marker for the %s extension", extension.Name)
+			}
+			if !strings.Contains(on, marker) {
+				t.Errorf("the sanitizer stripped %s from the output with the extension turned on", marker)
+			}
+			if strings.Contains(off, marker) {
+				t.Errorf("the output with the extension turned off contains %s", marker)
+			}
+			if sanitized := markdownPolicy.Sanitize(on); sanitized != on {
+				t.Errorf("sanitizing the output again changes it:\n%s", sanitized)
+			}
+		})
+	}
+}
+
+func TestParseMarkdownOptions(t *testing.T) {
+	opts := parseMarkdownOptions(allMarkdownExtensions)
+	if opts.String() != allMarkdownExtensions {
+		t.Errorf("parsing every extension gave %q", opts.String())
+	}
+
+	opts = parseMarkdownOptions(" emoji, unknown ,footnotes")
+	if opts.String() != "footnotes,emoji" {
+		t.Errorf("parsing a list with spaces and an unknown name gave %q", opts.String())
+	}
+}
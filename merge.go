@@ -0,0 +1,165 @@
+package main
+
+import "strings"
+
+// maxMergeCells bounds the table the longest common subsequence of two texts is found with. Texts that differ
+// over more lines than that are merged as a single block.
+const maxMergeCells = 4 << 20
+
+// Conflict markers put around the lines both versions of a text changed differently
+const (
+	conflictOurs   = "<<<<<<< Your version\n"
+	conflictSplit  = "=======\n"
+	conflictTheirs = ">>>>>>> Saved version\n"
+)
+
+// splitLines splits text into lines, each keeping its line ending
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// matchLines returns for every line of a the index of the line of b it is paired with in a longest common
+// subsequence of the two, or -1 if it isn't in it
+func matchLines(a, b []string) []int {
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+
+	//Lines both texts start and end with don't need the table
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		matches[start] = start
+		start++
+	}
+	endA, endB := len(a), len(b)
+	for endA > start && endB > start && a[endA-1] == b[endB-1] {
+		endA--
+		endB--
+		matches[endA] = endB
+	}
+
+	n, m := endA-start, endB-start
+	if n == 0 || m == 0 || n*m > maxMergeCells {
+		return matches
+	}
+
+	//lengths[i][j] is the length of the longest common subsequence of the lines from i and j on
+	lengths := make([][]int32, n+1)
+	for i := range lengths {
+		lengths[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[start+i] == b[start+j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case a[start+i] == b[start+j]:
+			matches[start+i] = start + j
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	return matches
+}
+
+// mergeLines merges two versions of a text that were both changed from base, line by line the way diff3 does.
+// Where both versions changed the same lines differently both are kept between conflict markers, and conflicts
+// is true.
+func mergeLines(base, ours, theirs string) (merged string, conflicts bool) {
+	//Every line gets a line ending, so a last line without one still matches the same line further up
+	normalize := func(text string) string {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		return text
+	}
+	baseLines := splitLines(normalize(base))
+	ourLines := splitLines(normalize(ours))
+	theirLines := splitLines(normalize(theirs))
+	ourMatches := matchLines(baseLines, ourLines)
+	theirMatches := matchLines(baseLines, theirLines)
+
+	var out strings.Builder
+	o, a, b := 0, 0, 0
+	for o < len(baseLines) || a < len(ourLines) || b < len(theirLines) {
+		//Lines neither version changed are copied as they are
+		if o < len(baseLines) && ourMatches[o] == a && theirMatches[o] == b {
+			out.WriteString(baseLines[o])
+			o, a, b = o+1, a+1, b+1
+			continue
+		}
+
+		//Anything else is changed up to the next line of base both versions kept
+		nextO, nextA, nextB := len(baseLines), len(ourLines), len(theirLines)
+		for i := o; i < len(baseLines); i++ {
+			if ourMatches[i] >= a && theirMatches[i] >= b {
+				nextO, nextA, nextB = i, ourMatches[i], theirMatches[i]
+				break
+			}
+		}
+
+		baseBlock := strings.Join(baseLines[o:nextO], "")
+		ourBlock := strings.Join(ourLines[a:nextA], "")
+		theirBlock := strings.Join(theirLines[b:nextB], "")
+		switch {
+		case ourBlock == baseBlock:
+			out.WriteString(theirBlock)
+		case theirBlock == baseBlock || ourBlock == theirBlock:
+			out.WriteString(ourBlock)
+		default:
+			conflicts = true
+			out.WriteString(conflictOurs + ourBlock + conflictSplit + theirBlock + conflictTheirs)
+		}
+		o, a, b = nextO, nextA, nextB
+	}
+
+	merged = out.String()
+	if !strings.HasSuffix(ours, "\n") {
+		merged = strings.TrimSuffix(merged, "\n")
+	}
+	return merged, conflicts
+}
+
+// mergeTags merges two versions of a note's tags that were both changed from base. Tags either version added are
+// kept and tags either version removed are dropped.
+func mergeTags(base, ours, theirs []string) []string {
+	contains := func(tags []string, tag string) bool {
+		for _, t := range tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}
+
+	merged := []string{}
+	for _, tag := range ours {
+		if !contains(base, tag) || contains(theirs, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	for _, tag := range theirs {
+		if !contains(base, tag) && !contains(merged, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
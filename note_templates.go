@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type NoteTemplate struct {
+	ID        int
+	UserID    int
+	Name      string
+	Title     string
+	Content   string
+	IsDefault bool
+}
+
+// defaultNoteTitle is the title of notes created without a template
+const defaultNoteTitle = "New Note"
+
+// noteTemplateRouter returns a router with the handlers for the "/templates" path
+func (app *App) noteTemplateRouter() *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Get("/", app.handleGetNoteTemplates)
+	router.Get("/picker", app.handleGetTemplatePicker)
+	router.Post("/", app.handleSaveNoteTemplate)
+	router.Delete("/{id}", app.handleDeleteNoteTemplate)
+	router.Post("/{id}/default", app.handleSetDefaultTemplate)
+	router.Delete("/default", app.handleClearDefaultTemplate)
+
+	return router
+}
+
+// expandNoteTemplate fills in the placeholders of a template for a note created at the given time.
+// {{date}} and {{time}} work in the title and content, {{title}} is the expanded title and only works in the content.
+func expandNoteTemplate(tmpl NoteTemplate, now time.Time) (string, string) {
+	replacer := strings.NewReplacer(
+		"{{date}}", now.Format(time.DateOnly),
+		"{{time}}", now.Format("15:04"),
+	)
+	title := strings.TrimSpace(replacer.Replace(tmpl.Title))
+	if title == "" {
+		title = defaultNoteTitle
+	}
+
+	content := strings.ReplaceAll(replacer.Replace(tmpl.Content), "{{title}}", title)
+
+	return title, content
+}
+
+// getNoteTemplates returns every template of a user, sorted by name, with the user's default marked
+func (app *App) getNoteTemplates(userID int) []NoteTemplate {
+	var templates []NoteTemplate
+	rows, err := app.db.Query(`SELECT t.id, t.user_id, t.name, t.title, t.content, COALESCE(s.default_template_id = t.id, false)
+		FROM note_templates t LEFT JOIN user_settings s ON s.user_id = t.user_id
+		WHERE t.user_id = $1
+		ORDER BY lower(t.name)`, userID)
+	if err != nil {
+		app.log.Println("Error getting note templates: ", err.Error())
+		return templates
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tmpl NoteTemplate
+		rows.Scan(&tmpl.ID, &tmpl.UserID, &tmpl.Name, &tmpl.Title, &tmpl.Content, &tmpl.IsDefault)
+		templates = append(templates, tmpl)
+	}
+
+	return templates
+}
+
+// getNoteTemplate returns a template of a user. If the user has no template with the ID,
+// the returned NoteTemplate has an ID of 0.
+func (app *App) getNoteTemplate(id, userID int) NoteTemplate {
+	var tmpl NoteTemplate
+	row := app.db.QueryRow("SELECT id, user_id, name, title, content FROM note_templates WHERE id = $1 AND user_id = $2", id, userID)
+	err := row.Scan(&tmpl.ID, &tmpl.UserID, &tmpl.Name, &tmpl.Title, &tmpl.Content)
+	if err != nil {
+		return NoteTemplate{}
+	}
+
+	return tmpl
+}
+
+// getDefaultNoteTemplate returns the template a user's new notes start from.
+// If they haven't chosen one, the returned NoteTemplate has an ID of 0.
+func (app *App) getDefaultNoteTemplate(userID int) NoteTemplate {
+	var id sql.NullInt64
+	err := app.db.QueryRow("SELECT default_template_id FROM user_settings WHERE user_id = $1", userID).Scan(&id)
+	if err != nil || !id.Valid {
+		return NoteTemplate{}
+	}
+
+	return app.getNoteTemplate(int(id.Int64), userID)
+}
+
+// createNoteTemplate stores a new template for a user
+func (app *App) createNoteTemplate(userID int, name, title, content string) error {
+	_, err := app.db.Exec("INSERT INTO note_templates(user_id, name, title, content) VALUES($1, $2, $3, $4)", userID, name, title, content)
+	return err
+}
+
+// deleteNoteTemplate deletes a template, as long as it belongs to the given user
+func (app *App) deleteNoteTemplate(id, userID int) error {
+	_, err := app.db.Exec("DELETE FROM note_templates WHERE id = $1 AND user_id = $2", id, userID)
+	return err
+}
+
+// setDefaultNoteTemplate makes a template the one the user's new notes start from. A NULL ID clears the default.
+func (app *App) setDefaultNoteTemplate(userID int, templateID sql.NullInt64) error {
+	_, err := app.db.Exec(`INSERT INTO user_settings(user_id, default_template_id) VALUES($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET default_template_id = EXCLUDED.default_template_id`, userID, templateID)
+	return err
+}
+
+// renderNoteTemplates renders the template management panel of a user to the ResponseWriter
+func (app *App) renderNoteTemplates(w http.ResponseWriter, userID int) {
+	err := app.templates.ExecuteTemplate(w, "note_templates", app.getNoteTemplates(userID))
+	if err != nil {
+		app.log.Println("Error executing note_templates template: ", err.Error())
+	}
+}
+
+// handleGetNoteTemplates renders the templates of the logged in user for the settings page
+func (app *App) handleGetNoteTemplates(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	app.renderNoteTemplates(w, userID)
+}
+
+// handleGetTemplatePicker renders the new note button, with a choice of template if the user has any
+func (app *App) handleGetTemplatePicker(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	data := struct {
+		Templates []NoteTemplate
+		Default   NoteTemplate
+	}{
+		Templates: app.getNoteTemplates(userID),
+	}
+	for _, tmpl := range data.Templates {
+		if tmpl.IsDefault {
+			data.Default = tmpl
+		}
+	}
+
+	err := app.templates.ExecuteTemplate(w, "template_picker", data)
+	if err != nil {
+		app.log.Println("Error executing template_picker template: ", err.Error())
+	}
+}
+
+// handleSaveNoteTemplate saves the title and content of a note as a new template of the logged in user.
+// The template is named after the answer to the htmx prompt, or the note's title if there is none.
+func (app *App) handleSaveNoteTemplate(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	noteID, err := strconv.Atoi(r.FormValue("note_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	note := app.getNoteByID(noteID, userID)
+	if note.ID == 0 {
+		app.sendErrorToast(w, "Note not found")
+		return
+	}
+
+	name := strings.TrimSpace(r.Header.Get("HX-Prompt"))
+	if name == "" {
+		name = note.Title
+	}
+	if len(name) > 100 {
+		app.sendErrorToast(w, "Template names can be at most 100 characters")
+		return
+	}
+
+	exceeded, err := app.quotaExceeded(userID, Usage{CopyBytes: int64(len(note.Title) + len(note.Content))})
+	if err != nil {
+		app.log.Println("Error checking quota: ", err.Error())
+		app.sendErrorToast(w, "Internal server error")
+		return
+	}
+	if exceeded != "" {
+		app.sendErrorToast(w, exceeded)
+		return
+	}
+
+	err = app.createNoteTemplate(userID, name, note.Title, note.Content)
+	if err != nil {
+		app.log.Println("Error saving note template: ", err.Error())
+		app.sendErrorToast(w, "Internal server error")
+		return
+	}
+
+	sendToast(w, "Saved template "+name)
+}
+
+// handleDeleteNoteTemplate deletes a template of the logged in user
+func (app *App) handleDeleteNoteTemplate(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = app.deleteNoteTemplate(id, userID)
+	if err != nil {
+		app.log.Println("Error deleting note template: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderNoteTemplates(w, userID)
+}
+
+// handleSetDefaultTemplate makes a template the one the logged in user's new notes start from
+func (app *App) handleSetDefaultTemplate(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tmpl := app.getNoteTemplate(id, userID)
+	if tmpl.ID == 0 {
+		app.sendErrorToastNoSwap(w, "Template not found")
+		return
+	}
+
+	err = app.setDefaultNoteTemplate(userID, sql.NullInt64{Int64: int64(tmpl.ID), Valid: true})
+	if err != nil {
+		app.log.Println("Error setting default note template: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderNoteTemplates(w, userID)
+}
+
+// handleClearDefaultTemplate makes the logged in user's new notes start out blank
+func (app *App) handleClearDefaultTemplate(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	err := app.setDefaultNoteTemplate(userID, sql.NullInt64{})
+	if err != nil {
+		app.log.Println("Error clearing default note template: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderNoteTemplates(w, userID)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNoteConflict is returned by updateNote when the note was changed since the version the save is based on
+var errNoteConflict = errors.New("the note was changed since it was loaded")
+
+// noteEditor is what the note editor is rendered from: the note as it is filled into the form, and the saved
+// version it is based on, which the form sends back so a save that conflicts with another one can be merged
+type noteEditor struct {
+	Note
+	Base Note
+	// Draft is the user's unsaved draft the editor was filled with, if there is one
+	Draft *noteDraft
+}
+
+// DraftStatus returns what the autosave indicator of the editor starts out showing
+func (e noteEditor) DraftStatus() draftStatus {
+	status := draftStatus{NoteID: e.ID}
+	if e.Draft != nil {
+		status.SavedAt = e.Draft.UpdatedAt
+	}
+	return status
+}
+
+// BaseChanged reports whether the note was saved again after the version the editor is based on
+func (e noteEditor) BaseChanged() bool {
+	return e.Base.Version != e.Version
+}
+
+// noteConflict is what the conflict view of a note is rendered from
+type noteConflict struct {
+	Yours     Note
+	Saved     Note
+	Editor    noteEditor
+	Conflicts bool
+}
+
+// noteJSON is how notes are represented to JSON clients
+type noteJSON struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	Tags      []string  `json:"tags"`
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// noteETag returns the entity tag of a version of a note
+func noteETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists the entity tag, or is "*". Weak tags
+// never match, the strong comparison is used for both headers.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsJSON reports whether a request comes from a JSON client rather than the htmx front end
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// writeNoteJSON writes a note to a JSON client with the entity tag of its version
+func writeNoteJSON(w http.ResponseWriter, note Note, status int) {
+	tags := note.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", noteETag(note.Version))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(noteJSON{
+		ID:        note.ID,
+		Title:     note.Title,
+		Content:   note.Content,
+		Tags:      tags,
+		Version:   note.Version,
+		UpdatedAt: note.UpdatedAt,
+	})
+}
+
+// readNoteBase reads the version of a note an edit form was loaded with from the request. If the form doesn't
+// carry one, the saved note stands in for it.
+func readNoteBase(r *http.Request, saved Note) Note {
+	base := saved
+	base.Version, _ = strconv.Atoi(r.FormValue("version"))
+	if _, ok := r.Form["base_content"]; ok {
+		base.Title = r.FormValue("base_title")
+		base.Content = r.FormValue("base_content")
+		base.Tags = parseTags(r.FormValue("base_tags"))
+	}
+	return base
+}
+
+// renderNoteConflict replaces the note editor with a view of both versions of a note that was saved from a
+// stale version, and an editor filled with a three way merge of the two. htmx only swaps successful responses,
+// so the view is sent with a 200 and retargeted at the editor.
+func (app *App) renderNoteConflict(w http.ResponseWriter, base, yours, saved Note) {
+	merged := saved
+	var conflicts bool
+	merged.Content, conflicts = mergeLines(base.Content, yours.Content, saved.Content)
+	merged.Tags = mergeTags(base.Tags, yours.Tags, saved.Tags)
+
+	//Titles are merged like a single line, a title both changed keeps the user's
+	merged.Title = yours.Title
+	if yours.Title == base.Title {
+		merged.Title = saved.Title
+	} else if saved.Title != base.Title && saved.Title != yours.Title {
+		conflicts = true
+	}
+
+	data := noteConflict{
+		Yours:     yours,
+		Saved:     saved,
+		Editor:    noteEditor{Note: merged, Base: saved},
+		Conflicts: conflicts,
+	}
+
+	w.Header().Set("HX-Retarget", "#note")
+	w.Header().Set("HX-Reswap", "outerHTML")
+	err := app.templates.ExecuteTemplate(w, "note_conflict", data)
+	if err != nil {
+		app.log.Println("Error executing note_conflict template: ", err.Error())
+	}
+}
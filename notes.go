@@ -1,21 +1,58 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
 )
 
 type Note struct {
-	ID          int
-	UserID      int
-	Title       string
-	Content     string
-	ContentHTML template.HTML
-	CreatedAt   string
+	ID            int
+	UserID        int
+	Title         string
+	Content       string
+	ContentHTML   template.HTML
+	TOC           template.HTML
+	ContentHash   string
+	CreatedAt     string
+	Permission    Permission
+	OwnerUsername string
+	Published     bool
+	Slug          string
+	PublishedAt   time.Time
+	Tags          []string
+	// Version goes up with every change to the title, content or tags
+	Version   int
+	UpdatedAt time.Time
+}
+
+// Permission is the level of access a user has to a note
+type Permission string
+
+const (
+	PermissionNone  Permission = ""
+	PermissionView  Permission = "view"
+	PermissionEdit  Permission = "edit"
+	PermissionOwner Permission = "owner"
+)
+
+// CanEdit reports whether the user the note was fetched for may change its title and content
+func (n Note) CanEdit() bool {
+	return n.Permission == PermissionEdit || n.Permission == PermissionOwner
+}
+
+// IsOwner reports whether the user the note was fetched for owns it
+func (n Note) IsOwner() bool {
+	return n.Permission == PermissionOwner
 }
 
 //Functions
@@ -26,18 +63,39 @@ func (app *App) noteRouter() http.Handler {
 
 	//Routes
 	router.Get("/", app.handleGetAllNotes)
+	router.Get("/shared", app.handleGetSharedNotes)
+	router.Post("/preview", app.handlePreviewNote)
 	router.Get("/{id}", app.handleGetNoteByID)
 	router.Post("/", app.handleNewNote)
 	router.Post("/{id}", app.handleUpdateNote)
 	router.Delete("/{id}", app.handleDeleteNote)
 
+	router.Post("/{id}/draft", app.handleSaveDraft)
+	router.Delete("/{id}/draft", app.handleDiscardDraft)
+
+	router.Post("/{id}/tasks", app.handleToggleTask)
+	router.Get("/{id}/backlinks", app.handleGetBacklinks)
+	router.Get("/{id}/export.pdf", app.handleExportNotePDF)
+
+	router.Get("/{id}/attachments", app.handleGetAttachments)
+	router.Post("/{id}/attachments", app.handleUploadAttachment)
+	router.Delete("/{id}/attachments/{attachmentID}", app.handleDeleteAttachment)
+
+	router.Get("/{id}/publish", app.handleGetPublishStatus)
+	router.Post("/{id}/publish", app.handlePublishNote)
+	router.Delete("/{id}/publish", app.handleUnpublishNote)
+
+	router.Get("/{id}/collaborators", app.handleGetCollaborators)
+	router.Post("/{id}/collaborators", app.handleAddCollaborator)
+	router.Delete("/{id}/collaborators/{userID}", app.handleRemoveCollaborator)
+
 	return router
 }
 
 // getAllNotes gets all notes from the db connection and returns them as a list of notes
 func (app *App) getAllNotes(userID int) []Note {
 	var notes []Note
-	rows, err := app.db.Query("SELECT * FROM notes WHERE user_id = $1", userID)
+	rows, err := app.db.Query("SELECT id, user_id, title, content, created_at FROM notes WHERE user_id = $1", userID)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
@@ -50,14 +108,52 @@ func (app *App) getAllNotes(userID int) []Note {
 	return notes
 }
 
+// getSharedNotes gets all notes that other users have shared with the given user, along with the
+// username of their owner and the permission granted
+func (app *App) getSharedNotes(userID int) []Note {
+	var notes []Note
+	rows, err := app.db.Query(`SELECT n.id, n.user_id, n.title, n.content, n.created_at, p.permission, u.username
+		FROM notes n
+		JOIN note_permissions p ON p.note_id = n.id
+		JOIN users u ON u.id = n.user_id
+		WHERE p.user_id = $1
+		ORDER BY n.id`, userID)
+	if err != nil {
+		fmt.Println(err.Error())
+		return notes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note Note
+		rows.Scan(&note.ID, &note.UserID, &note.Title, &note.Content, &note.CreatedAt, &note.Permission, &note.OwnerUsername)
+		notes = append(notes, note)
+	}
+
+	return notes
+}
+
 // getNoteByID takes an id as an argument and queries the db connection for a Note matching that id
-// and then returns a Note object
+// that the user either owns or has been granted access to. It then returns a Note object with the
+// user's permission set. If the user has no access, the returned Note has an ID of 0.
 func (app *App) getNoteByID(id, userID int) Note {
 	var note Note
-	row := app.db.QueryRow("SELECT * FROM notes WHERE id = $1 AND user_id = $2", id, userID)
-	err := row.Scan(&note.ID, &note.UserID, &note.Title, &note.Content, &note.CreatedAt)
+	var granted sql.NullString
+	row := app.db.QueryRow(`SELECT n.id, n.user_id, n.title, n.content, n.created_at, n.published, COALESCE(n.slug, ''), n.tags,
+		n.version, n.updated_at, p.permission
+		FROM notes n LEFT JOIN note_permissions p ON p.note_id = n.id AND p.user_id = $2
+		WHERE n.id = $1 AND (n.user_id = $2 OR p.user_id IS NOT NULL)`, id, userID)
+	err := row.Scan(&note.ID, &note.UserID, &note.Title, &note.Content, &note.CreatedAt, &note.Published, &note.Slug, pq.Array(&note.Tags),
+		&note.Version, &note.UpdatedAt, &granted)
 	if err != nil {
 		fmt.Println(err)
+		return Note{}
+	}
+
+	if note.UserID == userID {
+		note.Permission = PermissionOwner
+	} else {
+		note.Permission = Permission(granted.String)
 	}
 
 	return note
@@ -68,7 +164,7 @@ func (app *App) getNoteByID(id, userID int) Note {
 func (app *App) postNote(userID int, title, content string) Note {
 	var note Note
 
-	row, err := app.db.Query("INSERT INTO notes(user_id, title, content) VALUES($1, $2, $3) RETURNING *", userID, title, content)
+	row, err := app.db.Query("INSERT INTO notes(user_id, title, content) VALUES($1, $2, $3) RETURNING id, user_id, title, content, created_at", userID, title, content)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
@@ -79,23 +175,64 @@ func (app *App) postNote(userID int, title, content string) Note {
 		}
 	}
 
+	if note.ID != 0 {
+		err = app.saveNoteLinks(note.ID, note.Content)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+
 	return note
 }
 
-func (app *App) updateNote(id, userID int, title, content string) {
-	row := app.db.QueryRow("UPDATE notes SET title = $1, content = $2 WHERE id = $3 AND user_id = $4", title, content, id, userID)
-	err := row.Scan()
+// updateNote sets the title, content and tags of a note, updates the notes it links to and drops its cached renderings.
+// Unless version is 0 the note is only changed if it is still at that version, otherwise errNoteConflict is returned.
+// It returns the new version of the note. Callers must check that the user has edit permission first.
+func (app *App) updateNote(id, version int, title, content string, tags []string) (int, error) {
+	err := app.db.QueryRow(`UPDATE notes SET title = $1, content = $2, tags = $3, updated_at = now(), version = version + 1
+		WHERE id = $4 AND ($5 = 0 OR version = $5) RETURNING version`, title, content, pq.Array(tags), id, version).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errNoteConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+	app.renderCache.invalidate(noteSource(id))
+
+	err = app.saveNoteLinks(id, content)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
+
+	return version, nil
 }
 
+// deleteNote deletes a note along with its attachments, as long as it is owned by the given user
 func (app *App) deleteNote(id, userID int) {
-	row := app.db.QueryRow("DELETE FROM notes WHERE id = $1 AND user_id = $2 RETURNING id", id, userID)
-	err := row.Scan()
+	hashes := app.getAttachmentHashes(id)
+	_, err := app.db.Exec("DELETE FROM notes WHERE id = $1 AND user_id = $2", id, userID)
 	if err != nil {
 		fmt.Println(err.Error())
+		return
 	}
+	app.deleteUnusedBlobs(hashes)
+	app.renderCache.invalidate(noteSource(id))
+}
+
+// parseTags splits a comma separated list of tags, trimming whitespace and dropping empty and duplicate tags
+func parseTags(list string) []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	return tags
 }
 
 //Handlers
@@ -112,6 +249,18 @@ func (app *App) handleGetAllNotes(w http.ResponseWriter, r *http.Request) {
 	app.templates.ExecuteTemplate(w, "notes", notes)
 }
 
+// handleGetSharedNotes calls the getSharedNotes function and renders the returned notes to the ResponseWriter
+func (app *App) handleGetSharedNotes(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	notes := app.getSharedNotes(userID)
+	app.templates.ExecuteTemplate(w, "shared_notes", notes)
+}
+
 // handleGetNoteByID calls the queryNoteByID function and renders the returned note to the ResponseWriter
 func (app *App) handleGetNoteByID(w http.ResponseWriter, r *http.Request) {
 	userID := getUserIDFromContext(r)
@@ -129,27 +278,111 @@ func (app *App) handleGetNoteByID(w http.ResponseWriter, r *http.Request) {
 
 	note := app.getNoteByID(id, userID)
 
-	if note.UserID != userID {
+	if wantsJSON(r) {
+		if note.ID == 0 {
+			http.Error(w, "Note not found", http.StatusNotFound)
+			return
+		}
+		if etagMatches(r.Header.Get("If-None-Match"), noteETag(note.Version)) {
+			w.Header().Set("ETag", noteETag(note.Version))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeNoteJSON(w, note, http.StatusOK)
+		return
+	}
+
+	if note.ID == 0 {
 		app.templates.ExecuteTemplate(w, "error_toast", "Note not found")
 		return
 	}
 
-	if r.URL.Query().Get("edit") == "true" {
-		app.templates.ExecuteTemplate(w, "edit_note", note)
+	if r.URL.Query().Get("edit") == "true" && note.CanEdit() {
+		app.templates.ExecuteTemplate(w, "edit_note", app.openNoteEditor(note, userID))
 	} else {
-		safeHTMLString := mdToHTML(note.Content)
-		safeHTML := template.HTML(safeHTMLString)
-		note.ContentHTML = safeHTML
-		app.templates.ExecuteTemplate(w, "individual_note", note)
+		app.renderIndividualNote(w, note, userID)
 	}
 }
 
-// handleNewNote calls postNote with a default title and content.
+// renderIndividualNote renders a note in view mode to the ResponseWriter. Users who can edit the note
+// get task checkboxes they can toggle.
+func (app *App) renderIndividualNote(w http.ResponseWriter, note Note, userID int) {
+	opts := app.getMarkdownOptions(userID)
+	opts.InteractiveTasks = note.CanEdit()
+	opts.WikiLinks = app.getWikiLinks(note, userID)
+	opts.Attachments = app.getAttachmentLinks(note.Content, note.UserID, attachmentAccess{})
+
+	content, toc := app.renderMarkdown(noteSource(note.ID), note.Content, opts)
+	note.ContentHTML, note.TOC = template.HTML(content), template.HTML(toc)
+	note.ContentHash = contentHash(note.Content)
+	app.templates.ExecuteTemplate(w, "individual_note", note)
+}
+
+// handlePreviewNote renders the content from the form request through the same pipeline as the note view,
+// for the live preview in the editor. Wiki links are resolved against the notebook of the note being edited.
+func (app *App) handlePreviewNote(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	//Keep the preview as it is when the content is too large to save anyway
+	r.Body = http.MaxBytesReader(w, r.Body, 6*maxNoteBytes)
+	err := r.ParseForm()
+	content := r.FormValue("content")
+	if err != nil || len(content) > maxNoteBytes {
+		app.sendErrorToastNoSwap(w, fmt.Sprintf("Notes can be at most %s", formatBytes(maxNoteBytes)))
+		return
+	}
+
+	opts := app.getMarkdownOptions(userID)
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err == nil {
+		note := app.getNoteByID(id, userID)
+		if note.ID != 0 {
+			opts.WikiLinks = app.getWikiLinks(note, userID)
+			opts.Attachments = app.getAttachmentLinks(content, note.UserID, attachmentAccess{})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(mdToHTML(content, opts)))
+}
+
+// handleNewNote calls postNote with the title and content of the template chosen in the form request,
+// the user's default template if none was chosen, or a blank note if the choice is "blank" or there is no default.
 // It then redirects the user to the page to edit the new note
 func (app *App) handleNewNote(w http.ResponseWriter, r *http.Request) {
 	userID := getUserIDFromContext(r)
-	title := "New Note"
-	content := "Lorem ipsum..."
+	title := defaultNoteTitle
+	content := ""
+
+	var tmpl NoteTemplate
+	switch choice := r.FormValue("template"); choice {
+	case "":
+		tmpl = app.getDefaultNoteTemplate(userID)
+	case "blank":
+	default:
+		id, err := strconv.Atoi(choice)
+		if err == nil {
+			tmpl = app.getNoteTemplate(id, userID)
+		}
+	}
+	if tmpl.ID != 0 {
+		title, content = expandNoteTemplate(tmpl, time.Now())
+	}
+
+	exceeded, err := app.quotaExceeded(userID, Usage{Notes: 1, NoteBytes: int64(len(title) + len(content))})
+	if err != nil {
+		app.log.Println("Error checking quota: ", err.Error())
+		app.sendErrorToast(w, "Internal server error")
+		return
+	}
+	if exceeded != "" {
+		app.sendErrorToast(w, exceeded)
+		return
+	}
 
 	note := app.postNote(userID, title, content)
 	redirectURL := fmt.Sprintf("/notes/%d", note.ID)
@@ -158,7 +391,9 @@ func (app *App) handleNewNote(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleUpdateNote gathers the title and content fields from the request form data and calls updateNote with them
-// It then redirects the user to the notes page
+// It then redirects the user to the notes page. Saves are checked against the version of the note the edit form was
+// loaded with, and a stale save gets the conflict view instead. JSON clients send the note as JSON and the
+// version in an If-Match header, and get a 412 with the saved note if it doesn't match.
 func (app *App) handleUpdateNote(w http.ResponseWriter, r *http.Request) {
 	idString := chi.URLParam(r, "id")
 	id, err := strconv.Atoi(idString)
@@ -167,15 +402,139 @@ func (app *App) handleUpdateNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	jsonClient := wantsJSON(r)
+	fail := func(status int, message string) {
+		if jsonClient {
+			http.Error(w, message, status)
+		} else {
+			app.sendErrorToast(w, message)
+		}
+	}
+
+	//Leave room for the tags, the version the form was loaded with and form encoding on top of the note itself
+	r.Body = http.MaxBytesReader(w, r.Body, 6*maxNoteBytes)
+	var title, content string
+	var tags []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Title   string   `json:"title"`
+			Content string   `json:"content"`
+			Tags    []string `json:"tags"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("Notes can be at most %s", formatBytes(maxNoteBytes)))
+			return
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, "The request body is not a note")
+			return
+		}
+		title, content, tags = body.Title, body.Content, parseTags(strings.Join(body.Tags, ","))
+	} else {
+		err = r.ParseForm()
+		if err != nil {
+			fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("Notes can be at most %s", formatBytes(maxNoteBytes)))
+			return
+		}
+		title = r.FormValue("title")
+		content = r.FormValue("content")
+		tags = parseTags(r.FormValue("tags"))
+	}
+
 	userID := getUserIDFromContext(r)
-	title := r.FormValue("title")
-	content := r.FormValue("content")
 
-	app.updateNote(id, userID, title, content)
+	note := app.getNoteByID(id, userID)
+	if !note.CanEdit() {
+		fail(http.StatusForbidden, "You don't have permission to edit this note")
+		return
+	}
+
+	if len(title)+len(content) > maxNoteBytes {
+		fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("Notes can be at most %s", formatBytes(maxNoteBytes)))
+		return
+	}
+
+	//Notes count towards the quota of their owner, whoever edits them
+	exceeded, err := app.quotaExceeded(note.UserID, Usage{NoteBytes: int64(len(title) + len(content) - len(note.Title) - len(note.Content))})
+	if err != nil {
+		app.log.Println("Error checking quota: ", err.Error())
+		fail(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if exceeded != "" {
+		fail(http.StatusForbidden, exceeded)
+		return
+	}
+
+	//Forms carry the version they were loaded with. Requests without either that or an If-Match header are
+	//saved whatever the note's version.
+	base := readNoteBase(r, note)
+	version := base.Version
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !etagMatches(match, noteETag(note.Version)) {
+			writeNoteJSON(w, note, http.StatusPreconditionFailed)
+			return
+		}
+		version = note.Version
+	}
+
+	//Renaming rewrites the links in other notes, which anyone editing those would get a conflict from, so the
+	//editor asks before it happens
+	if !jsonClient && title != note.Title && r.FormValue("rename_confirmed") == "" {
+		relinked := app.relinkedNotes(note.UserID, note.ID, note.Title, title)
+		if len(relinked) > 0 {
+			w.Header().Set("HX-Retarget", "#rename_confirm")
+			w.Header().Set("HX-Reswap", "outerHTML")
+			err = app.templates.ExecuteTemplate(w, "rename_confirm", len(relinked))
+			if err != nil {
+				app.log.Println("Error executing rename_confirm template: ", err.Error())
+			}
+			return
+		}
+	}
+
+	_, err = app.updateNote(id, version, title, content, tags)
+	if errors.Is(err, errNoteConflict) {
+		saved := app.getNoteByID(id, userID)
+		switch {
+		case saved.ID == 0:
+			fail(http.StatusNotFound, "The note has been deleted")
+		case jsonClient:
+			writeNoteJSON(w, saved, http.StatusPreconditionFailed)
+		default:
+			yours := saved
+			yours.Title, yours.Content, yours.Tags = title, content, tags
+			app.renderNoteConflict(w, base, yours, saved)
+		}
+		return
+	}
+	if err != nil {
+		app.log.Println("Error updating note: ", err.Error())
+		fail(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	//The draft has been saved to the note
+	err = app.deleteDraft(id, userID)
+	if err != nil {
+		app.log.Println("Error deleting draft: ", err.Error())
+	}
+
+	if title != note.Title {
+		app.renameWikiLinks(note.UserID, note.ID, note.Title, title)
+	}
+
+	if jsonClient {
+		writeNoteJSON(w, app.getNoteByID(id, userID), http.StatusOK)
+		return
+	}
 	w.Header().Add("HX-Redirect", fmt.Sprintf("/notes/%d", id))
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleDeleteNote deletes a note if the user owns it, then redirects the user to the notes page
 func (app *App) handleDeleteNote(w http.ResponseWriter, r *http.Request) {
 	idString := chi.URLParam(r, "id")
 	id, err := strconv.Atoi(idString)
@@ -186,6 +545,12 @@ func (app *App) handleDeleteNote(w http.ResponseWriter, r *http.Request) {
 
 	userID := getUserIDFromContext(r)
 
+	note := app.getNoteByID(id, userID)
+	if !note.IsOwner() {
+		app.sendErrorToast(w, "Only the owner can delete this note")
+		return
+	}
+
 	app.deleteNote(id, userID)
 	w.Header().Add("HX-Redirect", "/notes")
 	w.WriteHeader(http.StatusOK)
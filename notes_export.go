@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// exportNotes writes every note of a user into a zip archive, one Markdown file per note with its metadata
+// in YAML front matter. Notes are read from the database and written out one at a time, so the archive is
+// never held in memory, and if out can be flushed each note is sent as soon as it is written.
+func (app *App) exportNotes(userID int, out io.Writer) error {
+	rows, err := app.db.Query(`SELECT id, title, content, tags, created_at, updated_at FROM notes
+		WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	zw := zip.NewWriter(out)
+	flusher, _ := out.(http.Flusher)
+	names := make(map[string]bool)
+
+	for rows.Next() {
+		var note Note
+		var createdAt, updatedAt time.Time
+		err = rows.Scan(&note.ID, &note.Title, &note.Content, pq.Array(&note.Tags), &createdAt, &updatedAt)
+		if err != nil {
+			return err
+		}
+
+		file, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     uniqueFilename(names, slugify(note.Title), ".md"),
+			Method:   zip.Deflate,
+			Modified: updatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		err = writeFrontMatter(file, note, createdAt, updatedAt)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(file, note.Content)
+		if err != nil {
+			return err
+		}
+
+		if flusher != nil {
+			err = zw.Flush()
+			if err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// uniqueFilename returns base+ext, numbering it if the name has already been used, and marks the name as used
+func uniqueFilename(used map[string]bool, base, ext string) string {
+	name := base + ext
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	used[name] = true
+	return name
+}
+
+// writeFrontMatter writes the YAML front matter block that starts an exported note
+func writeFrontMatter(w io.Writer, note Note, createdAt, updatedAt time.Time) error {
+	tags := make([]string, len(note.Tags))
+	for i, tag := range note.Tags {
+		tags[i] = yamlString(tag)
+	}
+
+	_, err := fmt.Fprintf(w, "---\nid: %d\ntitle: %s\ncreated: %s\nupdated: %s\ntags: [%s]\n---\n\n",
+		note.ID,
+		yamlString(note.Title),
+		createdAt.UTC().Format(time.RFC3339),
+		updatedAt.UTC().Format(time.RFC3339),
+		strings.Join(tags, ", "),
+	)
+	return err
+}
+
+// yamlString quotes a string as a YAML double quoted scalar. The escapes Go's quoting uses are all valid YAML.
+func yamlString(s string) string {
+	return strconv.Quote(s)
+}
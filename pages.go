@@ -10,6 +10,7 @@ import (
 type headerData struct {
 	Title      string
 	HideHeader bool
+	FeedURL    string
 }
 
 // handleIndex is a http.HandlerFunc that renders the index page to the ResponseWriter
@@ -130,3 +131,75 @@ func (app *App) handleSharelinkPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 }
+
+// handleSharelinksPage is a http.Handler that renders the list of the user's sharelinks to the ResponseWriter, it will redirect the request if the user is not logged in
+func (app *App) handleSharelinksPage(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	var data struct {
+		HeaderData headerData
+	}
+
+	data.HeaderData.Title = "Sharelinks"
+
+	app.templates.ExecuteTemplate(w, "sharelinks_page", data)
+}
+
+// handleSharelinkStatsPage is a http.Handler that renders the view statistics page of a sharelink, it will redirect the request if the user is not logged in
+func (app *App) handleSharelinkStatsPage(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		HeaderData headerData
+		ID         string
+	}{
+		headerData{
+			Title: "Sharelink Stats",
+		},
+		chi.URLParam(r, "id"),
+	}
+	err := app.templates.ExecuteTemplate(w, "sharelink_stats_page", data)
+	if err != nil {
+		app.log.Println("Error processing template: ", err.Error())
+	}
+}
+
+// handleSettingsPage is a http.Handler that renders the settings page to the ResponseWriter, it will redirect the request if the user is not logged in
+func (app *App) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	var data struct {
+		HeaderData headerData
+		IsAdmin    bool
+	}
+
+	data.HeaderData.Title = "Settings"
+	data.IsAdmin = app.isAdmin(userID)
+
+	app.templates.ExecuteTemplate(w, "settings_page", data)
+}
+
+// handleAdminPage is a http.Handler that renders the admin page to the ResponseWriter, it will redirect the request if the user is not an admin
+func (app *App) handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	if !app.isAdmin(getUserIDFromContext(r)) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	var data struct {
+		HeaderData headerData
+	}
+
+	data.HeaderData.Title = "Admin"
+
+	app.templates.ExecuteTemplate(w, "admin_page", data)
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-pdf/fpdf"
+	"github.com/gomarkdown/markdown/ast"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// Page margins of PDF exports, in millimetres
+const (
+	defaultPDFMargin = 20
+	minPDFMargin     = 5
+	maxPDFMargin     = 50
+)
+
+// pdfFontSize is the size of body text in PDF exports, in points
+const pdfFontSize = 11
+
+// pdfPageSizes maps the page sizes PDF exports can be laid out on to their names in fpdf
+var pdfPageSizes = map[string]string{
+	"a3":     "A3",
+	"a4":     "A4",
+	"a5":     "A5",
+	"letter": "Letter",
+	"legal":  "Legal",
+}
+
+// pdfHeadingSizes holds the font size of each heading level, in points
+var pdfHeadingSizes = [...]float64{0, 20, 16, 14, 12, pdfFontSize, pdfFontSize}
+
+// pdfImageTypes maps the content types of images that can be embedded in a PDF to their type in fpdf
+var pdfImageTypes = map[string]string{
+	"image/jpeg": "JPG",
+	"image/png":  "PNG",
+	"image/gif":  "GIF",
+}
+
+// pdfFonts are the fonts PDF exports are set in. The Go fonts cover far more than the Latin-1 of the
+// standard PDF fonts, and are embedded in the binary so no font files are needed at runtime.
+var pdfFonts = []struct {
+	family string
+	style  string
+	ttf    []byte
+}{
+	{"sans", "", goregular.TTF},
+	{"sans", "B", gobold.TTF},
+	{"sans", "I", goitalic.TTF},
+	{"sans", "BI", gobolditalic.TTF},
+	{"mono", "", gomono.TTF},
+	{"mono", "B", gomonobold.TTF},
+	{"mono", "I", gomonoitalic.TTF},
+	{"mono", "BI", gomonobolditalic.TTF},
+}
+
+// pdfOptions selects the page layout of a PDF export
+type pdfOptions struct {
+	// PageSize is one of the keys of pdfPageSizes
+	PageSize string
+	// Margin is the margin around every page, in millimetres
+	Margin float64
+	// BaseURL makes the links to attachments and pages of the app absolute, so they work from outside of it
+	BaseURL string
+	// Access is how links to attachments are signed
+	Access attachmentAccess
+}
+
+// parsePDFOptions reads the "size" and "margin" query parameters of a PDF export request,
+// falling back to A4 pages with a 20mm margin
+func parsePDFOptions(r *http.Request) pdfOptions {
+	opts := pdfOptions{PageSize: "a4", Margin: defaultPDFMargin, BaseURL: baseURL(r), Access: exportAttachmentAccess()}
+
+	size := strings.ToLower(r.URL.Query().Get("size"))
+	if _, ok := pdfPageSizes[size]; ok {
+		opts.PageSize = size
+	}
+
+	margin, err := strconv.ParseFloat(r.URL.Query().Get("margin"), 64)
+	if err == nil {
+		opts.Margin = min(max(margin, minPDFMargin), maxPDFMargin)
+	}
+
+	return opts
+}
+
+// pdfWriter lays out a parsed Markdown document on the pages of a PDF
+type pdfWriter struct {
+	app *App
+	pdf *fpdf.Fpdf
+	m   *markdownRenderer
+	// attachments holds the attachments the document may embed or link to, by ID
+	attachments map[int]Attachment
+	baseURL     string
+	access      attachmentAccess
+
+	// size is the current font size, in points
+	size float64
+	//Styles are counted, so they can nest
+	bold, italic, strike, mono int
+	// link is the address the current text links to, if any
+	link string
+	// red, green and blue make up the color of text that isn't a link
+	red, green, blue int
+	// images counts the images embedded so far, to give each a name
+	images int
+	// tight is set in tight lists, which have no space between their items
+	tight bool
+	// right and bottom are page margins, and height the height of pages, in millimetres
+	right, bottom, height float64
+}
+
+// writePDF lays out a note as a PDF document. Attachments referenced in the note are resolved against those
+// of ownerID, images among them are embedded and other files are linked to.
+func (app *App) writePDF(out io.Writer, title, md string, ownerID int, mdOpts markdownOptions, opts pdfOptions) error {
+	pdf := fpdf.NewCustom(&fpdf.InitType{UnitStr: "mm", SizeStr: pdfPageSizes[opts.PageSize]})
+	pdf.SetMargins(opts.Margin, opts.Margin, opts.Margin)
+	pdf.SetAutoPageBreak(true, opts.Margin)
+	pdf.SetTitle(title, true)
+	pdf.SetCreator("gonote", true)
+	for _, font := range pdfFonts {
+		pdf.AddUTF8FontFromBytes(font.family, font.style, font.ttf)
+	}
+
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-opts.Margin * 0.75)
+		pdf.SetFont("sans", "", 8)
+		pdf.SetTextColor(128, 128, 128)
+		pdf.CellFormat(0, 4, fmt.Sprintf("%d / {nb}", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+
+	//Resolve attachment references to themselves, so they are left for the writer to look up
+	attachments := make(map[int]Attachment)
+	mdOpts.Attachments = &attachmentLinks{urls: make(map[int]string)}
+	for _, match := range attachmentReference.FindAllStringSubmatch(md, -1) {
+		id, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		attachment := app.getAttachment(id)
+		if attachment.ID != 0 && attachment.UserID == ownerID {
+			attachments[id] = attachment
+			mdOpts.Attachments.urls[id] = match[0]
+		}
+	}
+	mdOpts.InteractiveTasks = false
+
+	doc, m := parseMarkdown(md, mdOpts)
+
+	w := &pdfWriter{app: app, pdf: pdf, m: m, attachments: attachments, baseURL: opts.BaseURL, access: opts.Access, size: pdfFontSize}
+	_, _, w.right, w.bottom = pdf.GetMargins()
+	_, w.height = pdf.GetPageSize()
+
+	pdf.AddPage()
+	w.bold++
+	w.size = pdfHeadingSizes[1] + 4
+	w.text(title)
+	w.bold--
+	w.size = pdfFontSize
+	w.endBlock()
+
+	w.render(doc)
+
+	return pdf.Output(out)
+}
+
+// lineHeight returns the height of a line of text in the current font size, in millimetres
+func (w *pdfWriter) lineHeight() float64 {
+	return w.size * 25.4 / 72 * 1.4
+}
+
+// applyFont sets the font and color of the PDF to the current text style
+func (w *pdfWriter) applyFont() {
+	family, style := "sans", ""
+	if w.mono > 0 {
+		family = "mono"
+	}
+	if w.bold > 0 {
+		style += "B"
+	}
+	if w.italic > 0 {
+		style += "I"
+	}
+	if w.strike > 0 {
+		style += "S"
+	}
+	if w.link != "" {
+		style += "U"
+	}
+	w.pdf.SetFont(family, style, w.size)
+
+	if w.link != "" {
+		w.pdf.SetTextColor(3, 105, 161)
+	} else {
+		w.pdf.SetTextColor(w.red, w.green, w.blue)
+	}
+}
+
+// text writes text in the current style, wrapping at the right margin
+func (w *pdfWriter) text(text string) {
+	if text == "" {
+		return
+	}
+	text = strings.ReplaceAll(text, "\n", " ")
+
+	w.applyFont()
+	if w.link != "" {
+		w.pdf.WriteLinkString(w.lineHeight(), text, w.link)
+	} else {
+		w.pdf.Write(w.lineHeight(), text)
+	}
+}
+
+// startBlock moves to the start of a new line, unless already there
+func (w *pdfWriter) startBlock() {
+	left, _, _, _ := w.pdf.GetMargins()
+	if w.pdf.GetX() > left+0.01 {
+		w.pdf.Ln(w.lineHeight())
+	}
+}
+
+// endBlock ends the current line and leaves space before the next block, except between the items of tight lists
+func (w *pdfWriter) endBlock() {
+	w.startBlock()
+	if !w.tight {
+		w.pdf.Ln(w.lineHeight() * 0.5)
+	}
+}
+
+// children renders every child of a node
+func (w *pdfWriter) children(node ast.Node) {
+	for _, child := range node.GetChildren() {
+		w.render(child)
+	}
+}
+
+// render lays out a node of the document
+func (w *pdfWriter) render(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.Heading:
+		w.startBlock()
+		w.pdf.Ln(w.lineHeight() * 0.5)
+		size := w.size
+		w.size = pdfHeadingSizes[min(max(node.Level, 1), len(pdfHeadingSizes)-1)]
+		w.bold++
+		w.children(node)
+		w.bold--
+		w.endBlock()
+		w.size = size
+
+	case *ast.Paragraph:
+		if w.m.tocMarkers[node] {
+			return
+		}
+		w.startBlock()
+		w.children(node)
+		w.endBlock()
+
+	case *ast.Text:
+		w.text(string(node.Literal))
+
+	case *ast.Softbreak:
+		w.text(" ")
+
+	case *ast.Hardbreak:
+		w.pdf.Ln(w.lineHeight())
+
+	case *ast.Emph:
+		w.italic++
+		w.children(node)
+		w.italic--
+
+	case *ast.Strong:
+		w.bold++
+		w.children(node)
+		w.bold--
+
+	case *ast.Del:
+		w.strike++
+		w.children(node)
+		w.strike--
+
+	case *ast.Code:
+		w.mono++
+		w.text(string(node.Literal))
+		w.mono--
+
+	case *ast.Link:
+		link := w.link
+		w.link = w.url(string(node.Destination))
+		w.children(node)
+		w.link = link
+
+	case *wikiLink:
+		//Other notes can't be linked to from outside of gonote, so wiki links are left as text
+		w.text(node.Label)
+
+	case *ast.Image:
+		w.image(node)
+
+	case *ast.CodeBlock:
+		w.codeBlock(node)
+
+	case *ast.List:
+		w.list(node)
+
+	case *ast.BlockQuote:
+		w.blockQuote(node)
+
+	case *ast.Table:
+		w.table(node)
+
+	case *ast.HorizontalRule:
+		w.startBlock()
+		y := w.pdf.GetY() + w.lineHeight()*0.5
+		pageWidth, _ := w.pdf.GetPageSize()
+		left, _, _, _ := w.pdf.GetMargins()
+		w.pdf.SetDrawColor(200, 200, 200)
+		w.pdf.Line(left, y, pageWidth-w.right, y)
+		w.pdf.Ln(w.lineHeight())
+
+	case *ast.HTMLBlock, *ast.HTMLSpan:
+		//Raw HTML can't be laid out without a browser, so it is left out
+
+	default:
+		w.children(node)
+	}
+}
+
+// url returns the address a link points to in the PDF, or an empty string if it can't be followed from outside of the app
+func (w *pdfWriter) url(destination string) string {
+	if id, ok := strings.CutPrefix(destination, "attachment:"); ok {
+		attachmentID, err := strconv.Atoi(id)
+		if _, found := w.attachments[attachmentID]; err != nil || !found {
+			return ""
+		}
+		return w.baseURL + attachmentURL(attachmentID, w.access)
+	}
+
+	parsed, err := url.Parse(destination)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case parsed.Scheme == "http" || parsed.Scheme == "https" || parsed.Scheme == "mailto":
+		return destination
+	case parsed.Scheme == "" && strings.HasPrefix(destination, "/"):
+		return w.baseURL + destination
+	}
+	return ""
+}
+
+// codeBlock lays out a code block in a monospaced font on a shaded background
+func (w *pdfWriter) codeBlock(block *ast.CodeBlock) {
+	w.startBlock()
+
+	size := w.size
+	w.size = pdfFontSize - 2
+	w.mono++
+	w.applyFont()
+	w.pdf.SetFillColor(243, 244, 246)
+	code := strings.TrimRight(strings.ReplaceAll(string(block.Literal), "\t", "    "), "\n")
+	w.pdf.MultiCell(0, w.lineHeight(), code, "", "L", true)
+	w.mono--
+	w.size = size
+
+	w.endBlock()
+}
+
+// list lays out a list, with each item indented past its bullet or number
+func (w *pdfWriter) list(list *ast.List) {
+	w.startBlock()
+
+	tight := w.tight
+	w.tight = list.Tight
+	left, _, _, _ := w.pdf.GetMargins()
+	number := list.Start
+	if number == 0 {
+		number = 1
+	}
+
+	for _, child := range list.GetChildren() {
+		item, ok := child.(*ast.ListItem)
+		if !ok {
+			continue
+		}
+
+		marker := "•"
+		if list.ListFlags&ast.ListTypeOrdered != 0 {
+			marker = fmt.Sprintf("%d.", number)
+			number++
+		}
+		if task, ok := w.m.tasks[item]; ok {
+			marker = "[ ]"
+			if task.Checked {
+				marker = "[x]"
+			}
+		}
+
+		w.startBlock()
+		w.applyFont()
+		indent := max(6, w.pdf.GetStringWidth(marker)+2)
+		w.pdf.SetX(left)
+		w.pdf.Write(w.lineHeight(), marker)
+		w.pdf.SetLeftMargin(left + indent)
+		w.pdf.SetX(left + indent)
+		w.children(item)
+		w.startBlock()
+		w.pdf.SetLeftMargin(left)
+	}
+
+	w.tight = tight
+	if !w.tight {
+		w.pdf.Ln(w.lineHeight() * 0.5)
+	}
+}
+
+// blockQuote lays out a block quote indented and in gray, with the title of admonitions in bold
+func (w *pdfWriter) blockQuote(quote *ast.BlockQuote) {
+	w.startBlock()
+
+	left, _, _, _ := w.pdf.GetMargins()
+	red, green, blue := w.red, w.green, w.blue
+	w.red, w.green, w.blue = 90, 90, 90
+	w.pdf.SetLeftMargin(left + 6)
+	w.pdf.SetX(left + 6)
+
+	if kind, ok := w.m.admonitions[quote]; ok {
+		w.bold++
+		w.text(admonitionKinds[kind])
+		w.bold--
+		w.pdf.Ln(w.lineHeight())
+	}
+	w.children(quote)
+
+	w.startBlock()
+	w.pdf.SetLeftMargin(left)
+	w.red, w.green, w.blue = red, green, blue
+}
+
+// table lays out a table with columns of equal width. Cells hold their plain text, wrapped to the column width.
+func (w *pdfWriter) table(table *ast.Table) {
+	w.startBlock()
+
+	var rows []*ast.TableRow
+	columns := 0
+	ast.WalkFunc(table, func(node ast.Node, entering bool) ast.WalkStatus {
+		if row, ok := node.(*ast.TableRow); ok && entering {
+			rows = append(rows, row)
+			columns = max(columns, len(row.GetChildren()))
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+	if columns == 0 {
+		return
+	}
+
+	size := w.size
+	w.size = pdfFontSize - 1
+	left, _, _, _ := w.pdf.GetMargins()
+	pageWidth, _ := w.pdf.GetPageSize()
+	width := (pageWidth - left - w.right) / float64(columns)
+	padding := w.pdf.GetCellMargin()
+	w.pdf.SetDrawColor(200, 200, 200)
+	w.pdf.SetFillColor(243, 244, 246)
+
+	for _, row := range rows {
+		cells := row.GetChildren()
+		header := false
+		lines := 1
+		for _, child := range cells {
+			cell, ok := child.(*ast.TableCell)
+			if !ok {
+				continue
+			}
+			header = header || cell.IsHeader
+			if cell.IsHeader {
+				w.bold++
+			}
+			w.applyFont()
+			lines = max(lines, len(w.pdf.SplitText(plainText(cell), width-2*padding)))
+			if cell.IsHeader {
+				w.bold--
+			}
+		}
+		height := float64(lines) * w.lineHeight()
+
+		y := w.pdf.GetY()
+		if y+height > w.height-w.bottom {
+			w.pdf.AddPage()
+			y = w.pdf.GetY()
+		}
+
+		for i := 0; i < columns; i++ {
+			x := left + float64(i)*width
+			style := "D"
+			if header {
+				style = "FD"
+			}
+			w.pdf.Rect(x, y, width, height, style)
+			if i >= len(cells) {
+				continue
+			}
+
+			cell, ok := cells[i].(*ast.TableCell)
+			if !ok {
+				continue
+			}
+			align := "L"
+			switch cell.Align {
+			case ast.TableAlignmentRight:
+				align = "R"
+			case ast.TableAlignmentCenter:
+				align = "C"
+			}
+
+			if cell.IsHeader {
+				w.bold++
+			}
+			w.applyFont()
+			w.pdf.SetXY(x, y)
+			w.pdf.MultiCell(width, w.lineHeight(), plainText(cell), "", align, false)
+			if cell.IsHeader {
+				w.bold--
+			}
+		}
+		w.pdf.SetXY(left, y+height)
+	}
+
+	w.size = size
+	w.endBlock()
+}
+
+// image embeds an image attachment, scaled down to fit the width of the page. Images that can't be embedded,
+// like ones hosted elsewhere, are replaced by their alt text linking to them.
+func (w *pdfWriter) image(image *ast.Image) {
+	alt := plainText(image)
+	data, imageType, ok := w.loadImage(string(image.Destination))
+
+	var info *fpdf.ImageInfoType
+	name := fmt.Sprintf("image-%d", w.images)
+	if ok {
+		w.images++
+		info = w.pdf.RegisterImageOptionsReader(name, fpdf.ImageOptions{ImageType: imageType}, bytes.NewReader(data))
+		//Some images are valid but not supported by fpdf, such as interlaced PNGs
+		if w.pdf.Err() {
+			w.app.log.Println("Error embedding image in PDF: ", w.pdf.Error().Error())
+			w.pdf.ClearError()
+			ok = false
+		}
+	}
+	if !ok || info == nil {
+		if alt == "" {
+			alt = string(image.Destination)
+		}
+		link := w.link
+		w.link = w.url(string(image.Destination))
+		w.text(alt)
+		w.link = link
+		return
+	}
+
+	w.startBlock()
+	left, _, _, _ := w.pdf.GetMargins()
+	pageWidth, _ := w.pdf.GetPageSize()
+
+	//Show images at their size on a 96 DPI screen, unless they don't fit on the page
+	width, height := info.Extent()
+	width, height = width*0.75, height*0.75
+	if maxWidth := pageWidth - left - w.right; width > maxWidth {
+		width, height = maxWidth, height*maxWidth/width
+	}
+	if maxHeight := w.height - 2*w.bottom; height > maxHeight {
+		width, height = width*maxHeight/height, maxHeight
+	}
+
+	y := w.pdf.GetY()
+	if y+height > w.height-w.bottom {
+		w.pdf.AddPage()
+		y = w.pdf.GetY()
+	}
+	w.pdf.ImageOptions(name, left, y, width, height, false, fpdf.ImageOptions{ImageType: imageType}, 0, w.link)
+	w.pdf.SetY(y + height)
+	w.endBlock()
+}
+
+// loadImage reads the data of an image attachment for embedding, preferring its largest width variant so
+// photos don't bloat the PDF. It returns false for anything else.
+func (w *pdfWriter) loadImage(destination string) ([]byte, string, bool) {
+	id, ok := strings.CutPrefix(destination, "attachment:")
+	if !ok {
+		return nil, "", false
+	}
+	attachmentID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, "", false
+	}
+	attachment, ok := w.attachments[attachmentID]
+	if !ok || !attachment.IsImage() {
+		return nil, "", false
+	}
+
+	data, contentType, err := w.app.readImage(attachment, imageVariantWidths[len(imageVariantWidths)-1])
+	if err != nil {
+		w.app.log.Println("Error reading image for PDF: ", err.Error())
+		return nil, "", false
+	}
+	imageType, ok := pdfImageTypes[contentType]
+	return data, imageType, ok
+}
+
+// handleExportNotePDF sends a note the logged in user can view as a PDF document
+func (app *App) handleExportNotePDF(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	note := app.getNoteByID(id, userID)
+	if note.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = app.sendArchive(w, r, slugify(note.Title)+".pdf", "application/pdf", func(out io.Writer) error {
+		return app.writePDF(out, note.Title, note.Content, note.UserID, app.getMarkdownOptions(userID), parsePDFOptions(r))
+	})
+	if err != nil {
+		app.log.Println("Error exporting note as PDF: ", err.Error())
+	}
+}
+
+// handleExportSharelinkPDF sends the content of a sharelink as a PDF document, once it has been unlocked if it has a password
+func (app *App) handleExportSharelinkPDF(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	note := app.getSharelinkContent(id)
+	if note.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(note.Password) > 0 && !isSharelinkUnlocked(r, id) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	//Links in the PDF stop working with the sharelink, like the ones on its page
+	opts := parsePDFOptions(r)
+	opts.Access = sharelinkAttachmentAccess(note.ID)
+	err := app.sendArchive(w, r, slugify(note.Title)+".pdf", "application/pdf", func(out io.Writer) error {
+		return app.writePDF(out, note.Title, note.Content, note.UserID, app.getMarkdownOptions(note.UserID), opts)
+	})
+	if err != nil {
+		app.log.Println("Error exporting sharelink as PDF: ", err.Error())
+	}
+}
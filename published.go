@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+type Profile struct {
+	Username string
+	Notes    []Note
+}
+
+// uniqueSlug returns a slug for the title that isn't used by any other note of the user,
+// adding a numbered suffix when needed
+func (app *App) uniqueSlug(userID, noteID int, title string) (string, error) {
+	base := slugify(title)
+	slug := base
+	for n := 2; ; n++ {
+		var taken bool
+		err := app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM notes WHERE user_id = $1 AND slug = $2 AND id <> $3)", userID, slug, noteID).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// publishNote makes a note visible on its owner's public profile. The slug is generated the first
+// time a note is published and kept from then on, so its URL stays stable even if the title changes.
+func (app *App) publishNote(note Note) error {
+	slug := note.Slug
+	if slug == "" {
+		var err error
+		slug, err = app.uniqueSlug(note.UserID, note.ID, note.Title)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := app.db.Exec("UPDATE notes SET published = true, slug = $1, published_at = COALESCE(published_at, now()) WHERE id = $2", slug, note.ID)
+	return err
+}
+
+// unpublishNote removes a note from its owner's public profile and feeds
+func (app *App) unpublishNote(noteID int) error {
+	_, err := app.db.Exec("UPDATE notes SET published = false WHERE id = $1", noteID)
+	return err
+}
+
+// getPublishedNotes returns the user's published notes, newest first
+func (app *App) getPublishedNotes(userID int) []Note {
+	var notes []Note
+	rows, err := app.db.Query(`SELECT id, user_id, title, content, created_at, slug, published_at, tags
+		FROM notes WHERE user_id = $1 AND published
+		ORDER BY published_at DESC`, userID)
+	if err != nil {
+		app.log.Println("Error getting published notes: ", err.Error())
+		return notes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note Note
+		rows.Scan(&note.ID, &note.UserID, &note.Title, &note.Content, &note.CreatedAt, &note.Slug, &note.PublishedAt, pq.Array(&note.Tags))
+		note.Published = true
+		notes = append(notes, note)
+	}
+
+	return notes
+}
+
+// getPublishedNoteBySlug returns the published note of a user with the given slug.
+// If there is no such note, the returned Note has an ID of 0.
+func (app *App) getPublishedNoteBySlug(userID int, slug string) Note {
+	var note Note
+	row := app.db.QueryRow(`SELECT id, user_id, title, content, created_at, slug, published_at, tags
+		FROM notes WHERE user_id = $1 AND slug = $2 AND published`, userID, slug)
+	err := row.Scan(&note.ID, &note.UserID, &note.Title, &note.Content, &note.CreatedAt, &note.Slug, &note.PublishedAt, pq.Array(&note.Tags))
+	if err != nil {
+		return Note{}
+	}
+	note.Published = true
+
+	return note
+}
+
+// getProfileUser looks up a user by the username in the URL.
+// If the user doesn't exist, it responds with a 404 and returns false.
+func (app *App) getProfileUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	username := strings.ToLower(chi.URLParam(r, "username"))
+	user, err := app.getUserByUsername(username)
+	if err != nil || user.ID == 0 {
+		http.NotFound(w, r)
+		return user, false
+	}
+
+	return user, true
+}
+
+// renderPublishStatus renders the publishing controls of a note to the ResponseWriter
+func (app *App) renderPublishStatus(w http.ResponseWriter, r *http.Request, noteID int) {
+	userID := getUserIDFromContext(r)
+	note := app.getNoteByID(noteID, userID)
+
+	data := struct {
+		NoteID    int
+		Published bool
+		URL       string
+	}{
+		NoteID:    note.ID,
+		Published: note.Published,
+	}
+
+	if note.Published {
+		user, err := app.getUserByID(note.UserID)
+		if err == nil {
+			data.URL = fmt.Sprintf("/u/%s/%s", user.Username, note.Slug)
+		}
+	}
+
+	err := app.templates.ExecuteTemplate(w, "publish_status", data)
+	if err != nil {
+		app.log.Println("Error executing publish_status template: ", err.Error())
+	}
+}
+
+// handleGetPublishStatus renders the publishing controls of a note, for the owner of the note only
+func (app *App) handleGetPublishStatus(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getOwnedNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	app.renderPublishStatus(w, r, note.ID)
+}
+
+// handlePublishNote publishes a note to its owner's public profile
+func (app *App) handlePublishNote(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getOwnedNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.publishNote(note)
+	if err != nil {
+		app.log.Println("Error publishing note: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderPublishStatus(w, r, note.ID)
+}
+
+// handleUnpublishNote removes a note from its owner's public profile
+func (app *App) handleUnpublishNote(w http.ResponseWriter, r *http.Request) {
+	note, ok := app.getOwnedNoteFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.unpublishNote(note.ID)
+	if err != nil {
+		app.log.Println("Error unpublishing note: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderPublishStatus(w, r, note.ID)
+}
+
+// handleProfilePage renders the public profile of a user, listing their published notes
+func (app *App) handleProfilePage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.getProfileUser(w, r)
+	if !ok {
+		return
+	}
+
+	profile := Profile{
+		Username: user.Username,
+		Notes:    app.getPublishedNotes(user.ID),
+	}
+
+	data := struct {
+		HeaderData headerData
+		Profile    Profile
+	}{
+		headerData{
+			Title:      profile.Username,
+			HideHeader: true,
+			FeedURL:    fmt.Sprintf("/u/%s/feed.atom", profile.Username),
+		},
+		profile,
+	}
+
+	err := app.templates.ExecuteTemplate(w, "profile_page", data)
+	if err != nil {
+		app.log.Println("Error executing profile_page template: ", err.Error())
+	}
+}
+
+// handlePublishedNotePage renders a single published note of a user
+func (app *App) handlePublishedNotePage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.getProfileUser(w, r)
+	if !ok {
+		return
+	}
+
+	note := app.getPublishedNoteBySlug(user.ID, chi.URLParam(r, "slug"))
+	if note.ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	opts := app.getMarkdownOptions(user.ID)
+	opts.Attachments = app.getAttachmentLinks(note.Content, user.ID, publishedAttachmentAccess(note.ID))
+	content, _ := app.renderMarkdown(noteSource(note.ID), note.Content, opts)
+	note.ContentHTML = template.HTML(content)
+
+	data := struct {
+		HeaderData headerData
+		Username   string
+		Note       Note
+	}{
+		headerData{
+			Title:      note.Title,
+			HideHeader: true,
+			FeedURL:    fmt.Sprintf("/u/%s/feed.atom", user.Username),
+		},
+		user.Username,
+		note,
+	}
+
+	err := app.templates.ExecuteTemplate(w, "published_note_page", data)
+	if err != nil {
+		app.log.Println("Error executing published_note_page template: ", err.Error())
+	}
+}
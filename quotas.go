@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Quota is how much a user may store. A limit of 0 means there is no limit.
+type Quota struct {
+	// TotalBytes limits the size of notes, attachments, sharelinks and templates together
+	TotalBytes      int64
+	Notes           int
+	AttachmentBytes int64
+}
+
+// TotalMB and AttachmentsMB return the limits in megabytes, the unit admins set them in
+func (q Quota) TotalMB() int64 {
+	return q.TotalBytes >> 20
+}
+
+func (q Quota) AttachmentsMB() int64 {
+	return q.AttachmentBytes >> 20
+}
+
+// Usage is how much a user stores, counted the same way as their Quota
+type Usage struct {
+	NoteBytes       int64
+	Notes           int
+	AttachmentBytes int64
+	// CopyBytes is the size of the sharelinks and templates, which keep copies of notes
+	CopyBytes int64
+}
+
+// TotalBytes returns the size of everything the user stores together
+func (u Usage) TotalBytes() int64 {
+	return u.NoteBytes + u.AttachmentBytes + u.CopyBytes
+}
+
+// maxNoteBytes is the largest a single note, title and content together, can be
+const maxNoteBytes = 1 << 20
+
+// Instance wide quotas used when GONOTE_QUOTA_TOTAL_MB, GONOTE_QUOTA_NOTES and GONOTE_QUOTA_ATTACHMENTS_MB are not set.
+// 0 means no limit, so existing instances keep working as before until an admin sets a quota.
+const (
+	defaultQuotaTotalMB       = 0
+	defaultQuotaNotes         = 0
+	defaultQuotaAttachmentsMB = 0
+)
+
+// quotaFromEnvironment reads the instance wide quota every user gets unless an admin overrides it
+func quotaFromEnvironment() Quota {
+	number := func(name string, fallback int) int {
+		value, err := strconv.Atoi(os.Getenv(name))
+		if err != nil || value < 0 {
+			return fallback
+		}
+		return value
+	}
+
+	return Quota{
+		TotalBytes:      int64(number("GONOTE_QUOTA_TOTAL_MB", defaultQuotaTotalMB)) << 20,
+		Notes:           number("GONOTE_QUOTA_NOTES", defaultQuotaNotes),
+		AttachmentBytes: int64(number("GONOTE_QUOTA_ATTACHMENTS_MB", defaultQuotaAttachmentsMB)) << 20,
+	}
+}
+
+// adminsFromEnvironment reads the usernames of the instance admins from the comma separated GONOTE_ADMINS
+// environment variable
+func adminsFromEnvironment() map[string]bool {
+	admins := make(map[string]bool)
+	for _, username := range strings.Split(os.Getenv("GONOTE_ADMINS"), ",") {
+		username = strings.ToLower(strings.TrimSpace(username))
+		if username != "" {
+			admins[username] = true
+		}
+	}
+	return admins
+}
+
+// isAdmin reports whether a user may change the quotas of other users
+func (app *App) isAdmin(userID int) bool {
+	if userID == 0 || len(app.admins) == 0 {
+		return false
+	}
+
+	user, err := app.getUserByID(userID)
+	if err != nil {
+		return false
+	}
+	return app.admins[strings.ToLower(user.Username)]
+}
+
+// getQuota returns the quota of a user, which is the instance wide quota unless an admin has overridden some of its limits
+func (app *App) getQuota(userID int) Quota {
+	quota := app.defaultQuota
+
+	var totalBytes, attachmentBytes sql.NullInt64
+	var notes sql.NullInt32
+	err := app.db.QueryRow("SELECT total_bytes, note_count, attachment_bytes FROM user_quotas WHERE user_id = $1", userID).Scan(&totalBytes, &notes, &attachmentBytes)
+	if err != nil {
+		return quota
+	}
+
+	if totalBytes.Valid {
+		quota.TotalBytes = totalBytes.Int64
+	}
+	if notes.Valid {
+		quota.Notes = int(notes.Int32)
+	}
+	if attachmentBytes.Valid {
+		quota.AttachmentBytes = attachmentBytes.Int64
+	}
+	return quota
+}
+
+// getUsage counts how much a user stores
+func (app *App) getUsage(userID int) (Usage, error) {
+	var usage Usage
+	err := app.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(octet_length(title) + octet_length(content)), 0) FROM notes WHERE user_id = $1", userID).Scan(&usage.Notes, &usage.NoteBytes)
+	if err != nil {
+		return usage, err
+	}
+
+	err = app.db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM attachments WHERE user_id = $1", userID).Scan(&usage.AttachmentBytes)
+	if err != nil {
+		return usage, err
+	}
+
+	err = app.db.QueryRow(`SELECT COALESCE(SUM(octet_length(title) + octet_length(content)), 0) FROM
+		(SELECT title, content FROM share_links WHERE user_id = $1 UNION ALL SELECT title, content FROM note_templates WHERE user_id = $1) copies`,
+		userID).Scan(&usage.CopyBytes)
+	return usage, err
+}
+
+// quotaExceeded checks whether storing more would take a user over their quota. The change is what would be added,
+// and may be negative for notes that shrink. It returns a message for the user if the quota would be exceeded,
+// or an empty string if not. Changes that don't add anything are always allowed, so users over their quota can
+// still tidy up.
+func (app *App) quotaExceeded(userID int, change Usage) (string, error) {
+	quota := app.getQuota(userID)
+	usage, err := app.getUsage(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if quota.Notes > 0 && change.Notes > 0 && usage.Notes+change.Notes > quota.Notes {
+		return fmt.Sprintf("You have reached your limit of %d notes", quota.Notes), nil
+	}
+	if quota.AttachmentBytes > 0 && change.AttachmentBytes > 0 && usage.AttachmentBytes+change.AttachmentBytes > quota.AttachmentBytes {
+		return fmt.Sprintf("This would take you over your attachment storage limit of %s", formatBytes(quota.AttachmentBytes)), nil
+	}
+	if quota.TotalBytes > 0 && change.TotalBytes() > 0 && usage.TotalBytes()+change.TotalBytes() > quota.TotalBytes {
+		return fmt.Sprintf("This would take you over your storage limit of %s", formatBytes(quota.TotalBytes)), nil
+	}
+
+	return "", nil
+}
+
+// setQuota stores an admin's override of a user's quota. NULL limits fall back to the instance wide quota.
+func (app *App) setQuota(userID int, totalBytes sql.NullInt64, notes sql.NullInt32, attachmentBytes sql.NullInt64) error {
+	_, err := app.db.Exec(`INSERT INTO user_quotas(user_id, total_bytes, note_count, attachment_bytes) VALUES($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET total_bytes = EXCLUDED.total_bytes, note_count = EXCLUDED.note_count,
+		attachment_bytes = EXCLUDED.attachment_bytes`, userID, totalBytes, notes, attachmentBytes)
+	return err
+}
+
+// formatBytes formats a size in bytes for people to read
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+// usageMeter is one row of the usage panel on the settings page
+type usageMeter struct {
+	Label string
+	Used  string
+	// Limit is empty if there is no limit
+	Limit   string
+	Percent int64
+}
+
+func newUsageMeter(label string, used, limit int64, format func(int64) string) usageMeter {
+	meter := usageMeter{Label: label, Used: format(used)}
+	if limit > 0 {
+		meter.Limit = format(limit)
+		meter.Percent = min(100, used*100/limit)
+	}
+	return meter
+}
+
+// handleGetUsage renders how much of their quota the logged in user has used
+func (app *App) handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	usage, err := app.getUsage(userID)
+	if err != nil {
+		app.log.Println("Error getting storage usage: ", err.Error())
+		app.sendErrorToast(w, "Internal server error")
+		return
+	}
+	quota := app.getQuota(userID)
+
+	count := func(n int64) string { return strconv.FormatInt(n, 10) }
+	meters := []usageMeter{
+		newUsageMeter("Storage", usage.TotalBytes(), quota.TotalBytes, formatBytes),
+		newUsageMeter("Notes", int64(usage.Notes), int64(quota.Notes), count),
+		newUsageMeter("Attachments", usage.AttachmentBytes, quota.AttachmentBytes, formatBytes),
+	}
+
+	err = app.templates.ExecuteTemplate(w, "usage", meters)
+	if err != nil {
+		app.log.Println("Error executing usage template: ", err.Error())
+	}
+}
+
+// adminRouter returns a router with the handlers for the "/admin" path, which only admins may use
+func (app *App) adminRouter() *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Use(app.requireAdmin)
+	router.Get("/quotas", app.handleGetQuotas)
+	router.Post("/quotas/{userID}", app.handleUpdateQuota)
+	router.Delete("/quotas/{userID}", app.handleResetQuota)
+
+	return router
+}
+
+// requireAdmin is middleware that refuses requests from anyone but the instance admins
+func (app *App) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.isAdmin(getUserIDFromContext(r)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userQuota is a row of the quota admin table
+type userQuota struct {
+	UserID   int
+	Username string
+	Usage    Usage
+	// The overridden limits, in the units of the form, empty where the instance wide limit applies
+	TotalMB       string
+	Notes         string
+	AttachmentsMB string
+}
+
+// TotalBytes formats the storage the user uses
+func (q userQuota) TotalBytes() string {
+	return formatBytes(q.Usage.TotalBytes())
+}
+
+// getUserQuotas lists every user with their usage and quota overrides, for admins
+func (app *App) getUserQuotas() []userQuota {
+	var quotas []userQuota
+	rows, err := app.db.Query(`SELECT u.id, u.username, COALESCE(n.count, 0), COALESCE(n.bytes, 0), COALESCE(a.bytes, 0), COALESCE(c.bytes, 0),
+			q.total_bytes, q.note_count, q.attachment_bytes
+		FROM users u
+		LEFT JOIN (SELECT user_id, COUNT(*) AS count, SUM(octet_length(title) + octet_length(content)) AS bytes FROM notes GROUP BY user_id) n ON n.user_id = u.id
+		LEFT JOIN (SELECT user_id, SUM(size) AS bytes FROM attachments GROUP BY user_id) a ON a.user_id = u.id
+		LEFT JOIN (SELECT user_id, SUM(octet_length(title) + octet_length(content)) AS bytes FROM
+			(SELECT user_id, title, content FROM share_links UNION ALL SELECT user_id, title, content FROM note_templates) copies
+			GROUP BY user_id) c ON c.user_id = u.id
+		LEFT JOIN user_quotas q ON q.user_id = u.id
+		ORDER BY u.username`)
+	if err != nil {
+		app.log.Println("Error getting user quotas: ", err.Error())
+		return quotas
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var quota userQuota
+		var totalBytes, attachmentBytes sql.NullInt64
+		var notes sql.NullInt32
+		rows.Scan(&quota.UserID, &quota.Username, &quota.Usage.Notes, &quota.Usage.NoteBytes, &quota.Usage.AttachmentBytes, &quota.Usage.CopyBytes, &totalBytes, &notes, &attachmentBytes)
+
+		if totalBytes.Valid {
+			quota.TotalMB = strconv.FormatInt(totalBytes.Int64>>20, 10)
+		}
+		if notes.Valid {
+			quota.Notes = strconv.Itoa(int(notes.Int32))
+		}
+		if attachmentBytes.Valid {
+			quota.AttachmentsMB = strconv.FormatInt(attachmentBytes.Int64>>20, 10)
+		}
+		quotas = append(quotas, quota)
+	}
+
+	return quotas
+}
+
+// renderQuotas renders the quota admin table to the ResponseWriter
+func (app *App) renderQuotas(w http.ResponseWriter) {
+	data := struct {
+		Default Quota
+		Users   []userQuota
+	}{
+		app.defaultQuota,
+		app.getUserQuotas(),
+	}
+
+	err := app.templates.ExecuteTemplate(w, "admin_quotas", data)
+	if err != nil {
+		app.log.Println("Error executing admin_quotas template: ", err.Error())
+	}
+}
+
+// handleGetQuotas renders the quota admin table
+func (app *App) handleGetQuotas(w http.ResponseWriter, r *http.Request) {
+	app.renderQuotas(w)
+}
+
+// handleUpdateQuota overrides the quota of a user with the limits from the form request.
+// Blank limits use the instance wide limit and 0 removes the limit.
+func (app *App) handleUpdateQuota(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	limit := func(name string) (sql.NullInt64, bool) {
+		value := strings.TrimSpace(r.FormValue(name))
+		if value == "" {
+			return sql.NullInt64{}, true
+		}
+		number, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || number < 0 {
+			return sql.NullInt64{}, false
+		}
+		return sql.NullInt64{Int64: number, Valid: true}, true
+	}
+
+	totalMB, okTotal := limit("total_mb")
+	notes, okNotes := limit("notes")
+	attachmentsMB, okAttachments := limit("attachments_mb")
+	if !okTotal || !okNotes || !okAttachments {
+		app.sendErrorToastNoSwap(w, "Limits must be whole numbers of at least 0")
+		return
+	}
+	totalMB.Int64 <<= 20
+	attachmentsMB.Int64 <<= 20
+
+	err = app.setQuota(userID, totalMB, sql.NullInt32{Int32: int32(notes.Int64), Valid: notes.Valid}, attachmentsMB)
+	if err != nil {
+		app.log.Println("Error setting quota: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderQuotas(w)
+}
+
+// handleResetQuota removes an admin's overrides of a user's quota
+func (app *App) handleResetQuota(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, err = app.db.Exec("DELETE FROM user_quotas WHERE user_id = $1", userID)
+	if err != nil {
+		app.log.Println("Error resetting quota: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderQuotas(w)
+}
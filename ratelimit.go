@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter counts attempts per key over a sliding window of time
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	attempts map[string][]time.Time
+}
+
+// newRateLimiter returns a *rateLimiter that allows limit attempts per key within the given window
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:    limit,
+		window:   window,
+		attempts: make(map[string][]time.Time),
+	}
+}
+
+// prune removes attempts for a key that have fallen outside of the window.
+// The caller must hold the lock.
+func (rl *rateLimiter) prune(key string, now time.Time) {
+	kept := rl.attempts[key][:0]
+	for _, attempt := range rl.attempts[key] {
+		if now.Sub(attempt) < rl.window {
+			kept = append(kept, attempt)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(rl.attempts, key)
+	} else {
+		rl.attempts[key] = kept
+	}
+}
+
+// attempt registers an attempt for the given key and reports whether it is allowed. Checking and counting happen
+// under one lock, so parallel attempts can't all get in before any of them is counted.
+func (rl *rateLimiter) attempt(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.prune(key, now)
+	if len(rl.attempts[key]) >= rl.limit {
+		return false
+	}
+	rl.attempts[key] = append(rl.attempts[key], now)
+	return true
+}
+
+// reset forgets every attempt for the given key
+func (rl *rateLimiter) reset(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	delete(rl.attempts, key)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterParallelAttempts(t *testing.T) {
+	rl := newRateLimiter(5, time.Minute)
+
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rl.attempt("link") {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 5 {
+		t.Errorf("%d parallel attempts were allowed, want 5", allowed.Load())
+	}
+	if !rl.attempt("other") {
+		t.Error("attempts for one key limited another")
+	}
+
+	rl.reset("link")
+	if !rl.attempt("link") {
+		t.Error("an attempt after a reset wasn't allowed")
+	}
+}
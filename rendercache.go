@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// rendererVersion is part of every render cache key. Bump it whenever a change to the Markdown
+// renderer or sanitizer changes the HTML produced for the same input.
+const rendererVersion = 2
+
+// defaultRenderCacheSize is the number of rendered documents kept in memory when GONOTE_RENDER_CACHE_SIZE is not set
+const defaultRenderCacheSize = 500
+
+// renderCacheStats publishes the render cache counters at /debug/vars
+var renderCacheStats = expvar.NewMap("render_cache")
+
+// renderedMarkdown is the output of rendering one document
+type renderedMarkdown struct {
+	HTML string
+	TOC  string
+}
+
+type renderCacheEntry struct {
+	key    string
+	source string
+	value  renderedMarkdown
+}
+
+// renderCache keeps the most recently used rendered documents in memory, evicting the least recently used
+// when it is full. Entries are keyed by everything that affects the output, so a stale entry is never returned,
+// but entries for content that changed are dropped early with invalidate to free the space.
+type renderCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+
+	hits, misses, evictions expvar.Int
+}
+
+// newRenderCache returns a cache holding up to size documents. A size of 0 disables caching.
+func newRenderCache(size int) *renderCache {
+	cache := &renderCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+
+	renderCacheStats.Set("hits", &cache.hits)
+	renderCacheStats.Set("misses", &cache.misses)
+	renderCacheStats.Set("evictions", &cache.evictions)
+	renderCacheStats.Set("entries", expvar.Func(func() any {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return cache.order.Len()
+	}))
+	renderCacheStats.Set("hit_rate", expvar.Func(func() any {
+		hits, misses := cache.hits.Value(), cache.misses.Value()
+		if hits+misses == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(hits+misses)
+	}))
+
+	return cache
+}
+
+// renderCacheSize reads the size of the render cache from the GONOTE_RENDER_CACHE_SIZE environment variable
+func renderCacheSize() int {
+	size, err := strconv.Atoi(os.Getenv("GONOTE_RENDER_CACHE_SIZE"))
+	if err != nil || size < 0 {
+		return defaultRenderCacheSize
+	}
+	return size
+}
+
+// get returns the cached rendering for a key, marking it as recently used
+func (c *renderCache) get(key string) (renderedMarkdown, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return renderedMarkdown{}, false
+	}
+
+	c.hits.Add(1)
+	c.order.MoveToFront(element)
+	return element.Value.(*renderCacheEntry).value, true
+}
+
+// put stores a rendering, evicting the least recently used entries if the cache is full
+func (c *renderCache) put(key, source string, value renderedMarkdown) {
+	if c.size == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&renderCacheEntry{key, source, value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*renderCacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+// invalidate drops every cached rendering of the given source
+func (c *renderCache) invalidate(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*renderCacheEntry)
+		if entry.source == source {
+			c.order.Remove(element)
+			delete(c.entries, entry.key)
+		}
+		element = next
+	}
+}
+
+// noteSource and sharelinkSource name what a cached rendering was made from, for invalidating it
+func noteSource(noteID int) string {
+	return fmt.Sprintf("note:%d", noteID)
+}
+
+func sharelinkSource(id string) string {
+	return "sharelink:" + id
+}
+
+// key returns a hash of the notes wiki links resolve to, so renderings are cached per set of link targets
+func (l *wikiLinks) key() string {
+	if l == nil {
+		return ""
+	}
+
+	titles := make([]string, 0, len(l.notes))
+	for title := range l.notes {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%t\n", l.create)
+	for _, title := range titles {
+		fmt.Fprintf(hash, "%d %s\n", l.notes[title], title)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// renderCacheKey identifies the rendering of Markdown with the given options
+func renderCacheKey(md string, opts markdownOptions) string {
+	return fmt.Sprintf("%s|%d|%s|%t|%s|%s", contentHash(md), rendererVersion, opts.String(), opts.InteractiveTasks, opts.WikiLinks.key(), opts.Attachments.key())
+}
+
+// renderMarkdown renders Markdown like mdToHTMLWithTOC, reusing a cached rendering if there is one.
+// The source names what the Markdown belongs to, see noteSource and sharelinkSource.
+func (app *App) renderMarkdown(source, md string, opts markdownOptions) (string, string) {
+	key := renderCacheKey(md, opts)
+	if rendered, ok := app.renderCache.get(key); ok {
+		return rendered.HTML, rendered.TOC
+	}
+
+	content, toc := mdToHTMLWithTOC(md, opts)
+	app.renderCache.put(key, source, renderedMarkdown{content, toc})
+
+	return content, toc
+}
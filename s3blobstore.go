@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is sent in place of the payload hash, so uploads can be streamed without hashing them first
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// blobPresigner is implemented by blob stores that can hand out temporary URLs to download blobs from directly,
+// instead of the contents being streamed through this server
+type blobPresigner interface {
+	// presignGet returns a URL the blob can be downloaded from until it expires. The query parameters are
+	// passed on to the store, S3 uses them to override the response headers.
+	presignGet(key string, expires time.Duration, query url.Values) (string, error)
+}
+
+// s3BlobStore keeps blobs as objects in a bucket of an S3 compatible object store, such as AWS S3 or MinIO.
+// Requests are signed with AWS Signature Version 4.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	// pathStyle puts the bucket in the path of the URL rather than the host name, which most self-hosted stores need
+	pathStyle bool
+	client    *http.Client
+}
+
+// newS3BlobStore configures an S3 blob store from the GONOTE_S3_ENDPOINT, GONOTE_S3_BUCKET, GONOTE_S3_REGION,
+// GONOTE_S3_ACCESS_KEY, GONOTE_S3_SECRET_KEY and GONOTE_S3_PATH_STYLE environment variables
+func newS3BlobStore() (*s3BlobStore, error) {
+	endpoint := os.Getenv("GONOTE_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+
+	store := &s3BlobStore{
+		endpoint:  parsed,
+		bucket:    os.Getenv("GONOTE_S3_BUCKET"),
+		region:    os.Getenv("GONOTE_S3_REGION"),
+		accessKey: os.Getenv("GONOTE_S3_ACCESS_KEY"),
+		secretKey: os.Getenv("GONOTE_S3_SECRET_KEY"),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if store.bucket == "" || store.accessKey == "" || store.secretKey == "" {
+		return nil, errors.New("GONOTE_S3_BUCKET, GONOTE_S3_ACCESS_KEY and GONOTE_S3_SECRET_KEY are required for the S3 blob store")
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+	if pathStyle := os.Getenv("GONOTE_S3_PATH_STYLE"); pathStyle != "" {
+		store.pathStyle, err = strconv.ParseBool(pathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GONOTE_S3_PATH_STYLE %q", pathStyle)
+		}
+	}
+
+	return store, nil
+}
+
+// objectURL returns the URL of the object with the given key
+func (s *s3BlobStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.RawQuery = ""
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	return &u
+}
+
+// put uploads a blob. S3 needs to know the size of an upload up front, so readers that can't seek
+// are spooled to a temporary file first.
+func (s *s3BlobStore) put(key string, contents io.Reader) error {
+	err := validBlobKey(key)
+	if err != nil {
+		return err
+	}
+
+	seeker, ok := contents.(io.ReadSeeker)
+	if !ok {
+		file, err := os.CreateTemp("", "gonote-blob-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		_, err = io.Copy(file, contents)
+		if err != nil {
+			return err
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		seeker = file
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = seeker.Seek(start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), io.NopCloser(seeker))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = end - start
+
+	_, err = s.do(req, http.StatusOK)
+	return err
+}
+
+func (s *s3BlobStore) get(key string) (io.ReadCloser, error) {
+	err := validBlobKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// delete removes a blob. S3 doesn't report deleting an object that doesn't exist as an error either.
+func (s *s3BlobStore) delete(key string) error {
+	err := validBlobKey(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do(req, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+// presignGet returns a signed URL for downloading a blob that works without any credentials until it expires
+func (s *s3BlobStore) presignGet(key string, expires time.Duration, query url.Values) (string, error) {
+	err := validBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	return s.presignGetAt(key, expires, query, time.Now().UTC()), nil
+}
+
+// presignGetAt returns the URL presignGet returns for an object when signed at the given time
+func (s *s3BlobStore) presignGetAt(key string, expires time.Duration, query url.Values, now time.Time) string {
+	u := s.objectURL(key)
+
+	params := url.Values{}
+	for name, values := range query {
+		params[name] = values
+	}
+	params.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	params.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(now))
+	params.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	params.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	params.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(params)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, canonicalRequest)
+	return u.String()
+}
+
+// do signs and sends a request, returning an error if the response status isn't one of the expected ones.
+// The body of a successful response is left for the caller to read and close.
+func (s *s3BlobStore) do(req *http.Request, expected ...int) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range expected {
+		if res.StatusCode == status {
+			return res, nil
+		}
+	}
+
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("S3 %s %s: %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(body)))
+}
+
+// sign adds the Authorization header of AWS Signature Version 4 to a request.
+// Only the host and the x-amz headers are signed, and the payload is left unsigned.
+func (s *s3BlobStore) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	canonicalRequest, signedHeaders := canonicalRequest(req)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.scope(now), signedHeaders, s.signature(now, canonicalRequest)))
+}
+
+// canonicalRequest returns the canonical request of Signature Version 4 for a request, which covers the host and
+// the x-amz headers but not the payload, and the names of the headers it covers
+func canonicalRequest(req *http.Request) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	return canonicalRequest, signedHeaders
+}
+
+// scope returns the credential scope of requests signed at the given time
+func (s *s3BlobStore) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request with a key derived from the secret key, the date and the region
+func (s *s3BlobStore) signature(now time.Time, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		s.scope(now),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters the way Signature Version 4 expects: sorted by name and value,
+// with spaces encoded as %20 rather than +
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except the unreserved characters of RFC 3986
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
@@ -0,0 +1,131 @@
+package main
+
+// schemaStatements are executed in order every time the app starts. Each statement
+// must be safe to run against a database that has already been migrated.
+var schemaStatements = []string{
+	`ALTER TABLE share_links ADD COLUMN IF NOT EXISTS password BYTEA`,
+	`ALTER TABLE share_links ADD COLUMN IF NOT EXISTS user_id INT REFERENCES users(id) ON DELETE CASCADE`,
+	`ALTER TABLE share_links ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`CREATE TABLE IF NOT EXISTS sharelink_views (
+		id SERIAL PRIMARY KEY,
+		sharelink_id TEXT NOT NULL,
+		viewed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		referrer TEXT NOT NULL DEFAULT '',
+		user_agent_family TEXT NOT NULL DEFAULT '',
+		is_bot BOOLEAN NOT NULL DEFAULT false
+	)`,
+	`CREATE INDEX IF NOT EXISTS sharelink_views_sharelink_id_idx ON sharelink_views(sharelink_id, viewed_at)`,
+	`CREATE TABLE IF NOT EXISTS note_permissions (
+		note_id INT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+		user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		permission TEXT NOT NULL CHECK (permission IN ('view', 'edit')),
+		PRIMARY KEY (note_id, user_id)
+	)`,
+	`ALTER TABLE notes ADD COLUMN IF NOT EXISTS published BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE notes ADD COLUMN IF NOT EXISTS slug TEXT`,
+	`ALTER TABLE notes ADD COLUMN IF NOT EXISTS published_at TIMESTAMPTZ`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS notes_user_id_slug_idx ON notes(user_id, slug)`,
+	`ALTER TABLE notes ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS user_settings (
+		user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		markdown_extensions TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS note_links (
+		source_id INT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+		target_title TEXT NOT NULL,
+		PRIMARY KEY (source_id, target_title)
+	)`,
+	`CREATE INDEX IF NOT EXISTS note_links_target_title_idx ON note_links(target_title)`,
+	`ALTER TABLE notes ADD COLUMN IF NOT EXISTS links_indexed BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE TABLE IF NOT EXISTS note_templates (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		title TEXT NOT NULL,
+		content TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS default_template_id INT REFERENCES note_templates(id) ON DELETE SET NULL`,
+	`CREATE TABLE IF NOT EXISTS attachments (
+		id SERIAL PRIMARY KEY,
+		note_id INT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+		user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		hash TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS attachments_note_id_idx ON attachments(note_id)`,
+	`CREATE INDEX IF NOT EXISTS attachments_hash_idx ON attachments(hash)`,
+	`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS width INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS height INT NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS user_quotas (
+		user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		total_bytes BIGINT,
+		note_count INT,
+		attachment_bytes BIGINT
+	)`,
+	`CREATE TABLE IF NOT EXISTS image_variants (
+		hash TEXT NOT NULL,
+		width INT NOT NULL,
+		content_type TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		PRIMARY KEY (hash, width)
+	)`,
+	`ALTER TABLE notes ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ`,
+	`UPDATE notes SET updated_at = created_at WHERE updated_at IS NULL`,
+	`ALTER TABLE notes ALTER COLUMN updated_at SET DEFAULT now()`,
+	`ALTER TABLE notes ALTER COLUMN updated_at SET NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS import_jobs (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		status TEXT NOT NULL,
+		total INT NOT NULL,
+		processed INT NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		finished_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS import_results (
+		id SERIAL PRIMARY KEY,
+		job_id INT NOT NULL REFERENCES import_jobs(id) ON DELETE CASCADE,
+		filename TEXT NOT NULL,
+		note_id INT REFERENCES notes(id) ON DELETE SET NULL,
+		error TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS import_results_job_id_idx ON import_results(job_id)`,
+	`ALTER TABLE notes ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1`,
+	`CREATE TABLE IF NOT EXISTS note_drafts (
+		note_id INT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+		user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		title TEXT NOT NULL,
+		content TEXT NOT NULL,
+		tags TEXT[] NOT NULL DEFAULT '{}',
+		base_version INT NOT NULL,
+		base_title TEXT NOT NULL,
+		base_content TEXT NOT NULL,
+		base_tags TEXT[] NOT NULL DEFAULT '{}',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (note_id, user_id)
+	)`,
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'sharelink_views_sharelink_id_fkey') THEN
+			DELETE FROM sharelink_views v WHERE NOT EXISTS (SELECT 1 FROM share_links s WHERE s.id = v.sharelink_id);
+			ALTER TABLE sharelink_views ADD CONSTRAINT sharelink_views_sharelink_id_fkey
+				FOREIGN KEY (sharelink_id) REFERENCES share_links(id) ON DELETE CASCADE;
+		END IF;
+	END $$`,
+}
+
+// migrate runs every statement in schemaStatements against the database, stopping at the first error
+func (app *App) migrate() error {
+	for _, statement := range schemaStatements {
+		_, err := app.db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
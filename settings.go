@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// settingsRouter returns a router with the handlers for the "/settings" path
+func (app *App) settingsRouter() *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Get("/markdown", app.handleGetMarkdownSettings)
+	router.Post("/markdown", app.handleUpdateMarkdownSettings)
+	router.Delete("/markdown", app.handleResetMarkdownSettings)
+	router.Get("/usage", app.handleGetUsage)
+
+	return router
+}
+
+// getMarkdownOptions returns the Markdown extensions a user renders notes with. Users who haven't
+// chosen their own, and anonymous visitors (userID 0), get the instance defaults.
+func (app *App) getMarkdownOptions(userID int) markdownOptions {
+	if userID == 0 {
+		return app.markdownDefaults
+	}
+
+	var extensions sql.NullString
+	err := app.db.QueryRow("SELECT markdown_extensions FROM user_settings WHERE user_id = $1", userID).Scan(&extensions)
+	if err != nil || !extensions.Valid {
+		return app.markdownDefaults
+	}
+
+	return parseMarkdownOptions(extensions.String)
+}
+
+// setMarkdownExtensions stores the user's own choice of Markdown extensions.
+// A NULL list makes the user fall back to the instance defaults.
+func (app *App) setMarkdownExtensions(userID int, extensions sql.NullString) error {
+	_, err := app.db.Exec(`INSERT INTO user_settings(user_id, markdown_extensions) VALUES($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET markdown_extensions = EXCLUDED.markdown_extensions`, userID, extensions)
+	return err
+}
+
+// renderMarkdownSettings renders the Markdown settings form of a user to the ResponseWriter
+func (app *App) renderMarkdownSettings(w http.ResponseWriter, userID int) {
+	data := struct {
+		Options    markdownOptions
+		Extensions any
+	}{
+		app.getMarkdownOptions(userID),
+		markdownExtensions,
+	}
+
+	err := app.templates.ExecuteTemplate(w, "markdown_settings", data)
+	if err != nil {
+		app.log.Println("Error executing markdown_settings template: ", err.Error())
+	}
+}
+
+// handleGetMarkdownSettings renders the Markdown settings form of the logged in user
+func (app *App) handleGetMarkdownSettings(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	app.renderMarkdownSettings(w, userID)
+}
+
+// handleUpdateMarkdownSettings stores the extensions checked in the form request as the user's own choice
+func (app *App) handleUpdateMarkdownSettings(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.ParseForm()
+	opts := parseMarkdownOptions(strings.Join(r.Form["extensions"], ","))
+
+	err := app.setMarkdownExtensions(userID, sql.NullString{String: opts.String(), Valid: true})
+	if err != nil {
+		app.log.Println("Error updating markdown settings: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderMarkdownSettings(w, userID)
+	sendToast(w, "Settings saved")
+}
+
+// handleResetMarkdownSettings makes the user fall back to the instance's default extensions
+func (app *App) handleResetMarkdownSettings(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	err := app.setMarkdownExtensions(userID, sql.NullString{})
+	if err != nil {
+		app.log.Println("Error resetting markdown settings: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderMarkdownSettings(w, userID)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// statsDays is the number of days shown in the daily views chart
+const statsDays = 30
+
+type SharelinkSummary struct {
+	ID        string
+	Title     string
+	CreatedAt time.Time
+	Views     int
+}
+
+type SharelinkStats struct {
+	ID          string
+	Title       string
+	IncludeBots bool
+	Views       int
+	FirstView   sql.NullTime
+	LastView    sql.NullTime
+	Referrers   []StatCount
+	Browsers    []StatCount
+	Daily       []DailyViews
+}
+
+type StatCount struct {
+	Label string
+	Count int
+}
+
+type DailyViews struct {
+	Day     time.Time
+	Count   int
+	Percent int
+}
+
+// botMarkers are lowercase substrings of user agents that belong to crawlers, link previewers and scripts
+var botMarkers = []string{"bot", "crawl", "spider", "slurp", "preview", "facebookexternalhit", "headless", "curl", "wget", "python", "go-http-client", "java/", "okhttp"}
+
+// classifyUserAgent reduces a user agent string to a coarse browser family and reports whether it looks like a bot.
+// Only the family is ever stored, never the full user agent.
+func classifyUserAgent(userAgent string) (string, bool) {
+	ua := strings.ToLower(userAgent)
+	if ua == "" {
+		return "Unknown", true
+	}
+
+	for _, marker := range botMarkers {
+		if strings.Contains(ua, marker) {
+			return "Bot", true
+		}
+	}
+
+	//Order matters, most browsers also claim to be Chrome, Safari or Mozilla
+	switch {
+	case strings.Contains(ua, "edg/"):
+		return "Edge", false
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		return "Opera", false
+	case strings.Contains(ua, "firefox/"):
+		return "Firefox", false
+	case strings.Contains(ua, "chrome/") || strings.Contains(ua, "crios/"):
+		return "Chrome", false
+	case strings.Contains(ua, "safari/"):
+		return "Safari", false
+	default:
+		return "Other", false
+	}
+}
+
+// referrerHost reduces a Referer header to the host it came from, dropping the path and query.
+// Visits without a referrer, or from this site itself, return an empty string.
+func referrerHost(referer string, ownHost string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host == strings.TrimPrefix(strings.ToLower(strings.Split(ownHost, ":")[0]), "www.") {
+		return ""
+	}
+
+	return host
+}
+
+// recordSharelinkView stores an anonymous view of a sharelink. Views by the owner of the sharelink are not counted.
+func (app *App) recordSharelinkView(sharelink Sharelink, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID != 0 && userID == sharelink.UserID {
+		return
+	}
+
+	family, isBot := classifyUserAgent(r.UserAgent())
+	referrer := referrerHost(r.Referer(), r.Host)
+
+	_, err := app.db.Exec("INSERT INTO sharelink_views(sharelink_id, referrer, user_agent_family, is_bot) VALUES($1, $2, $3, $4)", sharelink.ID, referrer, family, isBot)
+	if err != nil {
+		app.log.Println("Error recording sharelink view: ", err.Error())
+	}
+}
+
+// getSharelinksByUser returns every sharelink created by a user along with the number of views by people
+func (app *App) getSharelinksByUser(userID int) []SharelinkSummary {
+	var sharelinks []SharelinkSummary
+	rows, err := app.db.Query(`SELECT s.id, s.title, s.created_at, COUNT(v.id) FILTER (WHERE NOT v.is_bot)
+		FROM share_links s LEFT JOIN sharelink_views v ON v.sharelink_id = s.id
+		WHERE s.user_id = $1
+		GROUP BY s.id, s.title, s.created_at
+		ORDER BY s.created_at DESC`, userID)
+	if err != nil {
+		app.log.Println("Error getting sharelinks: ", err.Error())
+		return sharelinks
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sharelink SharelinkSummary
+		rows.Scan(&sharelink.ID, &sharelink.Title, &sharelink.CreatedAt, &sharelink.Views)
+		sharelinks = append(sharelinks, sharelink)
+	}
+
+	return sharelinks
+}
+
+// getStatCounts runs a query returning label and count pairs and collects them into a list
+func (app *App) getStatCounts(query string, args ...any) []StatCount {
+	var counts []StatCount
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		app.log.Println("Error getting sharelink stats: ", err.Error())
+		return counts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var count StatCount
+		rows.Scan(&count.Label, &count.Count)
+		counts = append(counts, count)
+	}
+
+	return counts
+}
+
+// getSharelinkStats aggregates the recorded views of a sharelink. Views from bots are left out unless includeBots is set.
+func (app *App) getSharelinkStats(sharelink Sharelink, includeBots bool) SharelinkStats {
+	stats := SharelinkStats{
+		ID:          sharelink.ID,
+		Title:       sharelink.Title,
+		IncludeBots: includeBots,
+	}
+
+	row := app.db.QueryRow("SELECT COUNT(*), MIN(viewed_at), MAX(viewed_at) FROM sharelink_views WHERE sharelink_id = $1 AND ($2 OR NOT is_bot)", sharelink.ID, includeBots)
+	err := row.Scan(&stats.Views, &stats.FirstView, &stats.LastView)
+	if err != nil {
+		app.log.Println("Error getting sharelink stats: ", err.Error())
+	}
+
+	stats.Referrers = app.getStatCounts(`SELECT referrer, COUNT(*) FROM sharelink_views
+		WHERE sharelink_id = $1 AND ($2 OR NOT is_bot)
+		GROUP BY referrer ORDER BY COUNT(*) DESC LIMIT 10`, sharelink.ID, includeBots)
+	stats.Browsers = app.getStatCounts(`SELECT user_agent_family, COUNT(*) FROM sharelink_views
+		WHERE sharelink_id = $1 AND ($2 OR NOT is_bot)
+		GROUP BY user_agent_family ORDER BY COUNT(*) DESC`, sharelink.ID, includeBots)
+
+	rows, err := app.db.Query(`SELECT day, COUNT(v.id)
+		FROM generate_series(current_date - $3::int, current_date, interval '1 day') AS day
+		LEFT JOIN sharelink_views v ON v.sharelink_id = $1 AND ($2 OR NOT v.is_bot) AND v.viewed_at::date = day::date
+		GROUP BY day ORDER BY day`, sharelink.ID, includeBots, statsDays-1)
+	if err != nil {
+		app.log.Println("Error getting daily sharelink views: ", err.Error())
+		return stats
+	}
+	defer rows.Close()
+
+	highest := 0
+	for rows.Next() {
+		var daily DailyViews
+		rows.Scan(&daily.Day, &daily.Count)
+		if daily.Count > highest {
+			highest = daily.Count
+		}
+		stats.Daily = append(stats.Daily, daily)
+	}
+
+	//Scale the bars of the chart relative to the busiest day
+	for i := range stats.Daily {
+		if highest > 0 {
+			stats.Daily[i].Percent = stats.Daily[i].Count * 100 / highest
+		}
+	}
+
+	return stats
+}
+
+// handleGetAllSharelinks renders the list of sharelinks created by the logged in user
+func (app *App) handleGetAllSharelinks(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	sharelinks := app.getSharelinksByUser(userID)
+	err := app.templates.ExecuteTemplate(w, "sharelinks", sharelinks)
+	if err != nil {
+		app.log.Println("Error executing sharelinks template: ", err.Error())
+	}
+}
+
+// handleGetSharelinkStats renders the view statistics of a sharelink to its owner.
+// Bots are filtered out unless the "bots" query parameter is set to true.
+func (app *App) handleGetSharelinkStats(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	sharelink := app.getSharelinkContent(id)
+	if sharelink.ID == "" || sharelink.UserID != userID {
+		app.sendErrorToast(w, "Sharelink not found")
+		return
+	}
+
+	includeBots := r.URL.Query().Get("bots") == "true"
+	stats := app.getSharelinkStats(sharelink, includeBots)
+
+	err := app.templates.ExecuteTemplate(w, "sharelink_stats", stats)
+	if err != nil {
+		app.log.Println("Error executing sharelink_stats template: ", err.Error())
+	}
+}
@@ -8,35 +8,48 @@ import (
 	"html/template"
 	"math"
 	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Sharelink struct {
 	ID          string
+	UserID      int
 	Title       string
 	Content     string
 	ContentHTML template.HTML
+	TOC         template.HTML
+	Password    []byte
 }
 
+// sharelinkUnlockDuration is how long a sharelink stays unlocked after the correct password is given
+const sharelinkUnlockDuration = 1 * time.Hour
+
 func (app *App) sharelinkRouter() *chi.Mux {
 	r := chi.NewRouter()
 
+	r.Get("/", app.handleGetAllSharelinks)
 	r.Post("/", app.handleCreateSharelink)
 	r.Get("/{id}", app.handleGetSharelink)
+	r.Get("/{id}/stats", app.handleGetSharelinkStats)
+	r.Get("/{id}/export.pdf", app.handleExportSharelinkPDF)
+	r.Post("/{id}/unlock", app.handleUnlockSharelink)
 
 	return r
 }
 
-func (app *App) createSharelink(title string, content string) string {
+// createSharelink inserts a new sharelink with a random ID into the database and returns the ID.
+// passwordHash may be nil, in which case the sharelink can be read by anyone holding the ID.
+func (app *App) createSharelink(userID int, title string, content string, passwordHash []byte) string {
 
-	buff := make([]byte, int(math.Ceil(float64(32)/2)))
-	_, err := rand.Read(buff)
+	str, err := newSharelinkID()
 	if err != nil {
 		app.log.Println("Error creating random string for sharelink: ", err.Error())
 	}
-	str := hex.EncodeToString(buff)
 
-	row := app.db.QueryRow("INSERT INTO share_links(id, title, content) VALUES($1, $2, $3) RETURNING *", str, title, content)
-	err = row.Scan()
+	_, err = app.db.Exec("INSERT INTO share_links(id, user_id, title, content, password) VALUES($1, $2, $3, $4, $5)", str, userID, title, content, passwordHash)
 	if err != nil {
 		app.log.Println("Error creating sharelink", err.Error())
 	}
@@ -44,10 +57,17 @@ func (app *App) createSharelink(title string, content string) string {
 	return str[:32]
 }
 
+// newSharelinkID returns a random ID for a sharelink
+func newSharelinkID() (string, error) {
+	buff := make([]byte, int(math.Ceil(float64(32)/2)))
+	_, err := rand.Read(buff)
+	return hex.EncodeToString(buff), err
+}
+
 func (app *App) getSharelinkContent(id string) Sharelink {
-	row := app.db.QueryRow("SELECT * FROM share_links WHERE id=$1", id)
+	row := app.db.QueryRow("SELECT id, COALESCE(user_id, 0), title, content, password FROM share_links WHERE id=$1", id)
 	var sharelink Sharelink
-	err := row.Scan(&sharelink.ID, &sharelink.Title, &sharelink.Content)
+	err := row.Scan(&sharelink.ID, &sharelink.UserID, &sharelink.Title, &sharelink.Content, &sharelink.Password)
 	if err != nil {
 		app.log.Println("Error getting sharelink", err.Error())
 	}
@@ -55,10 +75,44 @@ func (app *App) getSharelinkContent(id string) Sharelink {
 	return sharelink
 }
 
+// sharelinkCookieName returns the name of the cookie that holds the unlock token for a sharelink
+func sharelinkCookieName(id string) string {
+	return "sharelink_" + id
+}
+
+// isSharelinkUnlocked checks if the request carries a valid unlock token for the sharelink with the given ID
+func isSharelinkUnlocked(r *http.Request, id string) bool {
+	cookie, err := r.Cookie(sharelinkCookieName(id))
+	if err != nil {
+		return false
+	}
+
+	unlockedID, err := parseSharelinkJWT(cookie.Value)
+	return err == nil && unlockedID == id
+}
+
 func (app *App) handleGetSharelink(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	note := app.getSharelinkContent(id)
-	note.ContentHTML = template.HTML(mdToHTML(note.Content))
+	if note.ID == "" {
+		app.sendErrorToast(w, "Sharelink not found")
+		return
+	}
+
+	//Ask for the password if the sharelink is protected and hasn't been unlocked yet
+	if len(note.Password) > 0 && !isSharelinkUnlocked(r, id) {
+		err := app.templates.ExecuteTemplate(w, "sharelink_unlock", note.ID)
+		if err != nil {
+			app.log.Println("Error executing sharelink_unlock template: ", err.Error())
+		}
+		return
+	}
+
+	app.recordSharelinkView(note, r)
+	opts := app.getMarkdownOptions(note.UserID)
+	opts.Attachments = app.getAttachmentLinks(note.Content, note.UserID, sharelinkAttachmentAccess(note.ID))
+	content, toc := app.renderMarkdown(sharelinkSource(note.ID), note.Content, opts)
+	note.ContentHTML, note.TOC = template.HTML(content), template.HTML(toc)
 
 	err := app.templates.ExecuteTemplate(w, "sharelink", note)
 	if err != nil {
@@ -66,6 +120,65 @@ func (app *App) handleGetSharelink(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleUnlockSharelink checks the password from the form request against the hash stored for the sharelink.
+// If it matches, it sets a short-lived cookie granting access to the sharelink and renders its content.
+// Attempts are rate limited per sharelink, and unlocking it clears the count.
+func (app *App) handleUnlockSharelink(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	//Keep the unlock form in place if anything goes wrong
+	w.Header().Set("HX-Reswap", "none")
+
+	if !app.sharelinkUnlocks.attempt(id) {
+		app.sendErrorToast(w, "Too many attempts, try again later")
+		return
+	}
+
+	note := app.getSharelinkContent(id)
+	if note.ID == "" {
+		app.sendErrorToast(w, "Sharelink not found")
+		return
+	}
+
+	err := bcrypt.CompareHashAndPassword(note.Password, []byte(r.FormValue("password")))
+	if err != nil {
+		app.sendErrorToast(w, "Incorrect password")
+		return
+	}
+	app.sharelinkUnlocks.reset(id)
+
+	expirationTime := time.Now().Add(sharelinkUnlockDuration)
+	signedString, err := signSharelinkJWT(id, expirationTime)
+	if err != nil {
+		app.log.Println(err.Error())
+		app.sendErrorToast(w, "Internal Server Error")
+		return
+	}
+
+	//Attachments of the sharelink check the cookie too, so it's sent to all of the API
+	http.SetCookie(w, &http.Cookie{
+		Name:     sharelinkCookieName(id),
+		Value:    signedString,
+		Path:     "/api",
+		Expires:  expirationTime,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.Header().Del("HX-Reswap")
+	app.recordSharelinkView(note, r)
+	opts := app.getMarkdownOptions(note.UserID)
+	opts.Attachments = app.getAttachmentLinks(note.Content, note.UserID, sharelinkAttachmentAccess(note.ID))
+	content, toc := app.renderMarkdown(sharelinkSource(note.ID), note.Content, opts)
+	note.ContentHTML, note.TOC = template.HTML(content), template.HTML(toc)
+	err = app.templates.ExecuteTemplate(w, "sharelink", note)
+	if err != nil {
+		app.log.Println("Error executing sharelink template: ", err.Error())
+	}
+}
+
+// handleCreateSharelink creates a sharelink from the title and content in the form request.
+// The answer to the htmx prompt, if any, is used as the sharelink password.
 func (app *App) handleCreateSharelink(w http.ResponseWriter, r *http.Request) {
 	userID := getUserIDFromContext(r)
 	if userID == 0 {
@@ -73,12 +186,52 @@ func (app *App) handleCreateSharelink(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+
+	//Sharelinks keep a copy of the note, so they are limited like notes are
+	r.Body = http.MaxBytesReader(w, r.Body, 6*maxNoteBytes)
+	err := r.ParseForm()
+	if err != nil {
+		app.sendErrorToast(w, fmt.Sprintf("Notes can be at most %s", formatBytes(maxNoteBytes)))
+		return
+	}
 	title := r.FormValue("title")
 	content := r.FormValue("content")
+	password := strings.TrimSpace(r.Header.Get("HX-Prompt"))
+
+	if len(title)+len(content) > maxNoteBytes {
+		app.sendErrorToast(w, fmt.Sprintf("Notes can be at most %s", formatBytes(maxNoteBytes)))
+		return
+	}
+	exceeded, err := app.quotaExceeded(userID, Usage{CopyBytes: int64(len(title) + len(content))})
+	if err != nil {
+		app.log.Println("Error checking quota: ", err.Error())
+		app.sendErrorToast(w, "Internal Server Error")
+		return
+	}
+	if exceeded != "" {
+		app.sendErrorToast(w, exceeded)
+		return
+	}
 
-	app.log.Println(title, content)
+	var passwordHash []byte
+	if password != "" {
+		validator := NewValidator()
+		validator.ValidateSharelinkPassword(password)
+		if !validator.IsValid() {
+			app.sendErrorToast(w, "Password: "+strings.Join(validator.Errors["password"], ", "))
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+		if err != nil {
+			app.log.Println(err.Error())
+			app.sendErrorToast(w, "Internal Server Error")
+			return
+		}
+		passwordHash = hash
+	}
 
-	sharelink := app.createSharelink(title, content)
+	sharelink := app.createSharelink(userID, title, content, passwordHash)
 	redirect := fmt.Sprintf("/sharelink/%s", sharelink)
 	w.Header().Set("HX-Redirect", redirect)
 	w.WriteHeader(200)
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// siteWriter receives the files of a generated static site
+type siteWriter interface {
+	writeFile(name string, contents io.Reader) error
+}
+
+// dirSiteWriter writes the files of a static site into a directory on disk
+type dirSiteWriter struct {
+	root string
+}
+
+func (d dirSiteWriter) writeFile(name string, contents io.Reader) error {
+	fullPath := filepath.Join(d.root, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(fullPath), 0o755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(fullPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, contents)
+	return err
+}
+
+// zipSiteWriter writes the files of a static site into a zip archive
+type zipSiteWriter struct {
+	zw *zip.Writer
+}
+
+func (z zipSiteWriter) writeFile(name string, contents io.Reader) error {
+	file, err := z.zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, contents)
+	return err
+}
+
+type siteOptions struct {
+	// Tag limits the site to published notes with this tag, if set
+	Tag string
+	// BaseURL is where the site will be hosted. The sitemap is only generated if it is set,
+	// since sitemaps require absolute URLs.
+	BaseURL string
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// hasTag reports whether the note is tagged with the given tag
+func (n Note) hasTag(tag string) bool {
+	for _, t := range n.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSiteTemplate executes a template and writes the result to the site as the named file
+func (app *App) writeSiteTemplate(out siteWriter, name, templateName string, data any) error {
+	var buff bytes.Buffer
+	err := app.templates.ExecuteTemplate(&buff, templateName, data)
+	if err != nil {
+		return err
+	}
+
+	return out.writeFile(name, &buff)
+}
+
+// writeSiteAttachments writes the attachments a note refers to into the site under attachments/, each one only
+// once, and returns the links the note page is rendered with. Images are written as their largest variant like
+// in the other exports, other files as they were uploaded.
+func (app *App) writeSiteAttachments(note Note, ownerID int, written map[int]string, out siteWriter) (*attachmentLinks, error) {
+	links := &attachmentLinks{urls: make(map[int]string)}
+
+	attachments, err := app.getReferencedAttachments(note.Content, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range attachments {
+		name, ok := written[attachment.ID]
+		if !ok {
+			if attachment.IsImage() {
+				data, contentType, err := app.readImage(attachment, imageVariantWidths[len(imageVariantWidths)-1])
+				if err != nil {
+					return nil, err
+				}
+				name = fmt.Sprintf("attachments/%d%s", attachment.ID, exportImageExtensions[contentType])
+				err = out.writeFile(name, bytes.NewReader(data))
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				//Files keep their names, in a directory of their own so names can't collide
+				name = fmt.Sprintf("attachments/%d/%s", attachment.ID, cleanFilename(attachment.Filename))
+				blob, err := app.blobs.get(attachment.Hash)
+				if err != nil {
+					return nil, err
+				}
+				err = out.writeFile(name, blob)
+				blob.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+			written[attachment.ID] = name
+		}
+
+		//Note pages are in notes/, next to attachments/
+		links.urls[attachment.ID] = "../" + (&url.URL{Path: name}).EscapedPath()
+	}
+
+	return links, nil
+}
+
+// exportSite renders the published notes of a user into a self-contained static website: an index page,
+// one page per note, the attachments the notes refer to, the assets from the static directory and, if a base
+// URL is given, a sitemap. Every link in the site is relative so it can be hosted from any directory.
+func (app *App) exportSite(user User, opts siteOptions, out siteWriter) error {
+	var notes []Note
+	markdownOpts := app.getMarkdownOptions(user.ID)
+	written := make(map[int]string)
+	for _, note := range app.getPublishedNotes(user.ID) {
+		if opts.Tag == "" || note.hasTag(opts.Tag) {
+			var err error
+			markdownOpts.Attachments, err = app.writeSiteAttachments(note, user.ID, written, out)
+			if err != nil {
+				return err
+			}
+			note.ContentHTML = template.HTML(mdToHTML(note.Content, markdownOpts))
+			notes = append(notes, note)
+		}
+	}
+
+	title := user.Username
+	if opts.Tag != "" {
+		title = fmt.Sprintf("%s #%s", user.Username, opts.Tag)
+	}
+
+	err := app.writeSiteTemplate(out, "index.html", "site_index", struct {
+		Title     string
+		PageTitle string
+		Root      string
+		Notes     []Note
+	}{title, title, "", notes})
+	if err != nil {
+		return err
+	}
+
+	for _, note := range notes {
+		err = app.writeSiteTemplate(out, "notes/"+note.Slug+".html", "site_note", struct {
+			Title     string
+			PageTitle string
+			Root      string
+			Note      Note
+		}{title, note.Title + " - " + title, "../", note})
+		if err != nil {
+			return err
+		}
+	}
+
+	//Copy the stylesheets and images, pattern matches the /static/ file server
+	err = fs.WalkDir(os.DirFS("static"), ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		file, err := os.Open(filepath.Join("static", filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return out.writeFile(path.Join("static", name), file)
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.BaseURL == "" {
+		return nil
+	}
+
+	base := strings.TrimSuffix(opts.BaseURL, "/")
+	sitemap := sitemapURLSet{URLs: []sitemapURL{{Loc: base + "/index.html"}}}
+	for _, note := range notes {
+		sitemap.URLs = append(sitemap.URLs, sitemapURL{
+			Loc:     base + "/notes/" + note.Slug + ".html",
+			LastMod: note.PublishedAt.UTC().Format(time.DateOnly),
+		})
+	}
+
+	var buff bytes.Buffer
+	buff.WriteString(xml.Header)
+	err = xml.NewEncoder(&buff).Encode(sitemap)
+	if err != nil {
+		return err
+	}
+
+	return out.writeFile("sitemap.xml", &buff)
+}
+
+// exportSiteCommand runs the static site export from the command line, writing either a directory
+// or, if the output path ends in .zip, a zip archive. A zip archive that couldn't be written completely is removed.
+func exportSiteCommand(args []string) error {
+	flags := flag.NewFlagSet("export-site", flag.ExitOnError)
+	username := flags.String("user", "", "username whose published notes are exported")
+	output := flags.String("out", "site", "output directory, or zip archive if it ends in .zip")
+	tag := flags.String("tag", "", "only export published notes with this tag")
+	base := flags.String("base-url", "", "URL the site will be hosted at, used for the sitemap")
+	flags.Parse(args)
+
+	if *username == "" {
+		return errors.New("-user is required")
+	}
+
+	app := initializeApp()
+	defer app.db.Close()
+
+	user, err := app.getUserByUsername(strings.ToLower(*username))
+	if err != nil || user.ID == 0 {
+		return fmt.Errorf("could not find user %s", *username)
+	}
+
+	opts := siteOptions{Tag: *tag, BaseURL: *base}
+
+	if strings.HasSuffix(*output, ".zip") {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+
+		zw := zip.NewWriter(file)
+		err = app.exportSite(user, opts, zipSiteWriter{zw})
+		if err == nil {
+			err = zw.Close()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*output)
+			return err
+		}
+	} else {
+		err = app.exportSite(user, opts, dirSiteWriter{*output})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Exported site to " + *output)
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	// taskLine matches a task list item in Markdown source, including ones nested in lists or block quotes.
+	// The second group is the character inside the brackets.
+	taskLine = regexp.MustCompile(`^((?:[ \t]*>)*[ \t]*(?:[-*+]|[0-9]+[.)])[ \t]+\[)([ xX])(\][ \t]+\S)`)
+	// fenceLine matches the opening or closing line of a fenced code block
+	fenceLine = regexp.MustCompile("^(?:[ \t]*>)*[ \t]*(```|~~~)")
+)
+
+// contentHash returns a hash of a note's content, used to detect that it changed between loading and saving
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// findTasks returns the line numbers of every task list item in Markdown source, skipping fenced code blocks
+func findTasks(lines []string) []int {
+	var tasks []int
+	fence := ""
+	for i, line := range lines {
+		if match := fenceLine.FindStringSubmatch(line); match != nil {
+			if fence == "" {
+				fence = match[1]
+			} else if match[1] == fence {
+				fence = ""
+			}
+			continue
+		}
+		if fence == "" && taskLine.MatchString(line) {
+			tasks = append(tasks, i)
+		}
+	}
+
+	return tasks
+}
+
+// toggleTask flips the checkbox of the task with the given index in Markdown source, counting tasks
+// in the order they are rendered. The source is only changed if the tasks found in it line up exactly
+// with the tasks the parser finds, so an unusual document can never have the wrong line toggled.
+func toggleTask(md string, index int, opts markdownOptions) (string, bool) {
+	lines := strings.Split(md, "\n")
+	tasks := findTasks(lines)
+
+	_, m := parseMarkdown(md, opts)
+	if len(m.tasks) != len(tasks) || index < 0 || index >= len(tasks) {
+		return md, false
+	}
+
+	parsed := make([]bool, len(m.tasks))
+	for _, task := range m.tasks {
+		parsed[task.Index] = task.Checked
+	}
+	for i, line := range tasks {
+		checked := taskLine.FindStringSubmatch(lines[line])[2] != " "
+		if checked != parsed[i] {
+			return md, false
+		}
+	}
+
+	line := tasks[index]
+	mark := "x"
+	if parsed[index] {
+		mark = " "
+	}
+	lines[line] = taskLine.ReplaceAllString(lines[line], "${1}"+mark+"${3}")
+
+	return strings.Join(lines, "\n"), true
+}
+
+// handleToggleTask flips the task checkbox identified by its position in the note and renders the updated note.
+// The request carries the hash of the content it was rendered from, and is refused if the note changed since.
+func (app *App) handleToggleTask(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	index, err := strconv.Atoi(r.FormValue("task"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	note := app.getNoteByID(id, userID)
+	if !note.CanEdit() {
+		app.sendErrorToastNoSwap(w, "You don't have permission to edit this note")
+		return
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		app.log.Println("Error starting transaction: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+	defer tx.Rollback()
+
+	//Lock the note so nothing can change it between the check and the update
+	err = tx.QueryRow("SELECT content FROM notes WHERE id = $1 FOR UPDATE", id).Scan(&note.Content)
+	if err != nil {
+		app.log.Println("Error getting note content: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	if contentHash(note.Content) != r.FormValue("hash") {
+		app.renderIndividualNote(w, note, userID)
+		app.sendErrorToast(w, "The note was changed elsewhere and has been reloaded")
+		return
+	}
+
+	toggled, ok := toggleTask(note.Content, index, app.getMarkdownOptions(userID))
+	if !ok {
+		app.sendErrorToastNoSwap(w, "Could not find that task")
+		return
+	}
+
+	_, err = tx.Exec("UPDATE notes SET content = $1, updated_at = now(), version = version + 1 WHERE id = $2", toggled, id)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		app.log.Println("Error toggling task: ", err.Error())
+		app.sendErrorToastNoSwap(w, "Internal server error")
+		return
+	}
+
+	app.renderCache.invalidate(noteSource(id))
+	note.Content = toggled
+	app.renderIndividualNote(w, note, userID)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+)
+
+// tocMinHeadings is the number of headings a note needs before it gets a table of contents next to it.
+// A [TOC] marker inserts one regardless.
+const tocMinHeadings = 3
+
+// tocEntry is a heading listed in a table of contents
+type tocEntry struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+// isTOCMarker reports whether a paragraph holds nothing but a [TOC] marker
+func isTOCMarker(paragraph *ast.Paragraph) bool {
+	var text []byte
+	for _, child := range paragraph.Children {
+		leaf, ok := child.(*ast.Text)
+		if !ok {
+			return false
+		}
+		text = append(text, leaf.Literal...)
+	}
+
+	return strings.EqualFold(string(bytes.TrimSpace(text)), "[TOC]")
+}
+
+// plainText returns the plain text of a heading or other inline content, without any formatting or inline HTML
+func plainText(node ast.Node) string {
+	var text []byte
+	ast.WalkFunc(node, func(node ast.Node, entering bool) ast.WalkStatus {
+		if _, isHTML := node.(*ast.HTMLSpan); isHTML {
+			return ast.GoToNext
+		}
+		if leaf := node.AsLeaf(); leaf != nil && entering {
+			text = append(text, leaf.Literal...)
+		}
+		return ast.GoToNext
+	})
+
+	return strings.TrimSpace(string(text))
+}
+
+// findHeadings lists every heading in a parsed document that has an ID to link to. The parser gives
+// each heading an ID based on its text, numbering repeated ones, so the IDs are unique within the document
+// and stay the same between renders.
+func findHeadings(doc ast.Node) []tocEntry {
+	var headings []tocEntry
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		heading, ok := node.(*ast.Heading)
+		if ok && entering && heading.HeadingID != "" && !heading.IsTitleblock {
+			headings = append(headings, tocEntry{
+				Level: heading.Level,
+				ID:    heading.HeadingID,
+				Text:  plainText(heading),
+			})
+		}
+		return ast.GoToNext
+	})
+
+	return headings
+}
+
+// renderTOC writes a table of contents as a list of links to the headings, with the highest level heading
+// in the document at level 1
+func renderTOC(w io.Writer, headings []tocEntry) {
+	if len(headings) == 0 {
+		return
+	}
+
+	top := headings[0].Level
+	for _, heading := range headings {
+		top = min(top, heading.Level)
+	}
+
+	io.WriteString(w, "<div class=\"toc\">\n<ul>\n")
+	for _, heading := range headings {
+		fmt.Fprintf(w, "<li class=\"toc-level-%d\"><a href=\"#", heading.Level-top+1)
+		html.EscapeHTML(w, []byte(heading.ID))
+		io.WriteString(w, "\">")
+		html.EscapeHTML(w, []byte(heading.Text))
+		io.WriteString(w, "</a></li>\n")
+	}
+	io.WriteString(w, "</ul>\n</div>\n")
+}
@@ -14,12 +14,22 @@ func (app *App) getUserByUsername(username string) (User, error) {
 	if err != nil {
 		return user, err
 	}
+	defer row.Close()
 	if row.Next() {
 		err = row.Scan(&user.ID, &user.Username, &user.Password)
 	}
 	return user, err
 }
 
+// getUserByID queries the database for a user ID and returns a User struct with the
+// information gathered
+func (app *App) getUserByID(id int) (User, error) {
+	var user User
+	row := app.db.QueryRow("SELECT id, username, password FROM users WHERE id=$1", id)
+	err := row.Scan(&user.ID, &user.Username, &user.Password)
+	return user, err
+}
+
 // createUser takes a username and password hash as input and inserts them into the database
 func (app *App) createUser(username ValidUsername, passwordHash []byte) (User, error) {
 	var user User
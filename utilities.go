@@ -2,18 +2,17 @@ package main
 
 import (
 	"database/sql"
+	"expvar"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/gomarkdown/markdown"
-	"github.com/gomarkdown/markdown/html"
-	"github.com/gomarkdown/markdown/parser"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
-	"github.com/microcosm-cc/bluemonday"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
@@ -23,31 +22,22 @@ type App struct {
 	templates *template.Template
 	db        *sql.DB
 	log       *log.Logger
+
+	sharelinkUnlocks *rateLimiter
+	markdownDefaults markdownOptions
+	renderCache      *renderCache
+	blobs            blobStore
+	defaultQuota     Quota
+	admins           map[string]bool
 }
 
 type contextKey string
 
 const userIDKey contextKey = "userID"
 
-// initializeApp initializes the app database and routes and starts the HTTP server on the given port
-func startApp() {
-	mux := chi.NewMux()
-
-	//Recommended default middleware stack
-	mux.Use(middleware.RequestID)
-	mux.Use(middleware.RealIP)
-	mux.Use(middleware.Logger)
-	mux.Use(middleware.Recoverer)
-
-	//Custom middleware
-	mux.Use(checkAuthentication)
-
-	//Select port from environment variable or default to :3000
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
-	}
-
+// initializeApp loads the environment, connects to the database, parses the templates and
+// migrates the database schema, then returns the resulting app. The caller must close app.db.
+func initializeApp() *App {
 	//Load .env if one exists
 	godotenv.Load()
 
@@ -62,7 +52,12 @@ func startApp() {
 	if err != nil {
 		log.Fatalln("Could not connect to Postgres database")
 	}
-	defer db.Close()
+
+	//Open the storage for attachments
+	blobs, err := newBlobStore()
+	if err != nil {
+		log.Fatalln("Could not open blob storage: ", err.Error())
+	}
 
 	//Parse all templates
 	templates := template.Must(template.ParseGlob("templates/*/*.html"))
@@ -72,12 +67,60 @@ func startApp() {
 		templates: templates,
 		db:        db,
 		log:       log.Default(),
+
+		sharelinkUnlocks: newRateLimiter(5, 15*time.Minute),
+		renderCache:      newRenderCache(renderCacheSize()),
+		blobs:            blobs,
+		defaultQuota:     quotaFromEnvironment(),
+		admins:           adminsFromEnvironment(),
+	}
+
+	//Read the instance wide Markdown extensions, enabling all of them by default
+	markdownExtensions, ok := os.LookupEnv("GONOTE_MARKDOWN_EXTENSIONS")
+	if !ok {
+		markdownExtensions = allMarkdownExtensions
 	}
+	app.markdownDefaults = parseMarkdownOptions(markdownExtensions)
+
+	//Bring the database schema up to date
+	err = app.migrate()
+	if err != nil {
+		log.Fatalln("Could not migrate database: ", err.Error())
+	}
+	app.indexNoteLinks()
+	app.failInterruptedImports()
+
+	return app
+}
+
+// startApp initializes the app database and routes and starts the HTTP server on the given port
+func startApp() {
+	mux := chi.NewMux()
+
+	//Recommended default middleware stack
+	mux.Use(middleware.RequestID)
+	mux.Use(middleware.RealIP)
+	mux.Use(middleware.Logger)
+	mux.Use(middleware.Recoverer)
+
+	//Custom middleware
+	mux.Use(checkAuthentication)
+
+	//Select port from environment variable or default to :3000
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+
+	app := initializeApp()
+	defer app.db.Close()
 
 	//Mount routers and utility handlers
 	mux.Mount("/", app.frontendRouter())
 	mux.Mount("/api", app.apiRouter())
 	mux.Get("/freshtoast", app.handleEmptyToast)
+	//The metrics include the command line and memory stats, so only admins get to see them
+	mux.Handle("/debug/vars", app.requireAdmin(expvar.Handler()))
 
 	//Add static file server, pattern from Alex Edwards
 	fs := http.FileServer(http.Dir("./static"))
@@ -104,6 +147,13 @@ func (app *App) sendErrorToast(w http.ResponseWriter, errorMessage string) {
 	app.templates.ExecuteTemplate(w, "error_toast", errorMessage)
 }
 
+// sendErrorToastNoSwap sends back an error toast like sendErrorToast, but tells htmx to leave the
+// element targeted by the request untouched
+func (app *App) sendErrorToastNoSwap(w http.ResponseWriter, errorMessage string) {
+	w.Header().Set("HX-Reswap", "none")
+	app.sendErrorToast(w, errorMessage)
+}
+
 // handleEmptyToast is called after a toast message has timed out on the front end
 // it responds with an empty toast message to serve as a placeholder for the next
 // toast message.
@@ -119,8 +169,18 @@ func (app *App) frontendRouter() *chi.Mux {
 	router.Get("/login", app.handleLoginPage)
 	router.Get("/register", app.handleRegisterPage)
 	router.Get("/notes", app.handleNotesPage)
+	router.Get("/notes/new", app.handleNewNoteFromLink)
+	router.Post("/notes/new", app.handleCreateNoteFromLink)
 	router.Get("/notes/{id}", app.handleIndividualNotePage)
+	router.Get("/settings", app.handleSettingsPage)
+	router.Get("/admin", app.handleAdminPage)
+	router.Get("/sharelinks", app.handleSharelinksPage)
 	router.Get("/sharelink/{id}", app.handleSharelinkPage)
+	router.Get("/sharelink/{id}/stats", app.handleSharelinkStatsPage)
+	router.Get("/u/{username}", app.handleProfilePage)
+	router.Get("/u/{username}/feed.atom", app.handleAtomFeed)
+	router.Get("/u/{username}/feed.json", app.handleJSONFeed)
+	router.Get("/u/{username}/{slug}", app.handlePublishedNotePage)
 
 	return router
 }
@@ -132,23 +192,53 @@ func (app *App) apiRouter() *chi.Mux {
 	router.Mount("/notes", app.noteRouter())
 	router.Mount("/auth", app.authRouter())
 	router.Mount("/sharelink", app.sharelinkRouter())
+	router.Mount("/export", app.exportRouter())
+	router.Mount("/import", app.importRouter())
+	router.Mount("/backup", app.backupRouter())
+	router.Mount("/settings", app.settingsRouter())
+	router.Mount("/templates", app.noteTemplateRouter())
+	router.Mount("/attachments", app.attachmentRouter())
+	router.Mount("/admin", app.adminRouter())
 
 	return router
 }
 
-func mdToHTML(md string) string {
-	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock
-	p := parser.NewWithExtensions(extensions)
-	doc := p.Parse([]byte(md))
-
-	htmlFlags := html.CommonFlags | html.HrefTargetBlank
-	opts := html.RendererOptions{Flags: htmlFlags}
-	renderer := html.NewRenderer(opts)
+// slugify turns a title into a lowercase, URL safe string of letters, digits and dashes.
+// If nothing usable is left, it returns "note".
+func slugify(title string) string {
+	var b strings.Builder
+	lastDash := true
+	for _, char := range strings.ToLower(title) {
+		if b.Len() >= 60 {
+			break
+		}
+		switch {
+		case (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9'):
+			b.WriteRune(char)
+			lastDash = false
+		case !lastDash:
+			b.WriteRune('-')
+			lastDash = true
+		}
+	}
 
-	unsafeHTMLDoc := markdown.Render(doc, renderer)
+	slug := strings.Trim(b.String(), "-")
+	if slug == "" {
+		return "note"
+	}
+	return slug
+}
 
-	policy := bluemonday.UGCPolicy()
-	safeHTML := policy.SanitizeBytes(unsafeHTMLDoc)
+// baseURL returns the address the app is reachable at, taken from the GONOTE_BASE_URL environment
+// variable or else from the request itself. It never has a trailing slash.
+func baseURL(r *http.Request) string {
+	if base := os.Getenv("GONOTE_BASE_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
 
-	return string(safeHTML)
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
 }
@@ -100,4 +100,13 @@ func (v *Validator) ValidatePassword(password string) {
 	v.CheckRequiredCharacterGroup(password, "abcdefghijklmnopqrstuvwxyz", "Must contain at least one lowercase letter", errorKey)
 	//Check for 1 number
 	v.CheckRequiredCharacterGroup(password, "1234567890", "Must contain at least 1 number", errorKey)
+}
+
+// ValidateSharelinkPassword validates a sharelink password given a standard set of rules
+func (v *Validator) ValidateSharelinkPassword(password string) {
+	errorKey := "password"
+
+	v.CheckMinLength(4, password, errorKey)
+	//bcrypt ignores everything past 72 bytes
+	v.CheckMaxLength(72, password, errorKey)
 }
\ No newline at end of file
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// wikiLinkPattern matches a [[Note Title]] or [[Note Title|alias]] link at the start of the input
+var wikiLinkPattern = regexp.MustCompile(`^\[\[([^\[\]|\n]+)(?:\|([^\[\]\n]+))?\]\]`)
+
+// wikiLink is a [[wiki link]] to another note, found by the parser
+type wikiLink struct {
+	ast.Leaf
+
+	Target string
+	Label  string
+}
+
+// wikiLinks resolves [[wiki links]] to notes for mdToHTML
+type wikiLinks struct {
+	// notes maps lowercase note titles to note IDs
+	notes map[string]int
+	// create links titles without a note to a page that creates the note
+	create bool
+}
+
+// wikiLinkKey normalizes a note title for matching links to it, links ignore case and surrounding spaces
+func wikiLinkKey(title string) string {
+	return strings.ToLower(strings.TrimSpace(title))
+}
+
+// registerWikiLinks makes the parser read [[wiki links]], leaving every other use of [ to the regular link parser
+func registerWikiLinks(p *parser.Parser) {
+	link := p.RegisterInline('[', nil)
+	p.RegisterInline('[', func(p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+		match := wikiLinkPattern.FindSubmatch(data[offset:])
+		if match == nil || len(strings.TrimSpace(string(match[1]))) == 0 {
+			return link(p, data, offset)
+		}
+
+		node := &wikiLink{
+			Target: strings.TrimSpace(string(match[1])),
+			Label:  strings.TrimSpace(string(match[2])),
+		}
+		if node.Label == "" {
+			node.Label = node.Target
+		}
+		node.Literal = []byte(node.Label)
+
+		return len(match[0]), node
+	})
+}
+
+// renderWikiLink writes a [[wiki link]] as a link to the note it names. Links to notes that don't exist
+// either point to a page that creates the note, or render as plain text when there is nothing to resolve them against.
+func renderWikiLink(w io.Writer, link *wikiLink, links *wikiLinks) {
+	label := html.EscapeString(link.Label)
+	if links == nil {
+		io.WriteString(w, label)
+		return
+	}
+
+	id, ok := links.notes[wikiLinkKey(link.Target)]
+	switch {
+	case ok:
+		fmt.Fprintf(w, "<a class=\"wiki-link\" href=\"/notes/%d\">%s</a>", id, label)
+	case links.create:
+		fmt.Fprintf(w, "<a class=\"wiki-link wiki-link-missing\" href=\"/notes/new?title=%s\">%s</a>", url.QueryEscape(link.Target), label)
+	default:
+		io.WriteString(w, label)
+	}
+}
+
+// findWikiLinks returns the normalized titles of every note linked to from Markdown source
+func findWikiLinks(md string) []string {
+	var targets []string
+	seen := make(map[string]bool)
+
+	doc, _ := parseMarkdown(md, markdownOptions{})
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if link, ok := node.(*wikiLink); ok && entering {
+			key := wikiLinkKey(link.Target)
+			if !seen[key] {
+				seen[key] = true
+				targets = append(targets, key)
+			}
+		}
+		return ast.GoToNext
+	})
+
+	return targets
+}
+
+// replaceWikiLinkTarget points every [[wiki link]] to oldTitle in Markdown source at newTitle instead,
+// keeping aliases. Fenced code blocks are left alone.
+func replaceWikiLinkTarget(md, oldTitle, newTitle string) string {
+	pattern := regexp.MustCompile(`(?i)\[\[[ \t]*` + regexp.QuoteMeta(strings.TrimSpace(oldTitle)) + `[ \t]*(\|[^\[\]\n]+)?\]\]`)
+
+	lines := strings.Split(md, "\n")
+	fence := ""
+	for i, line := range lines {
+		if match := fenceLine.FindStringSubmatch(line); match != nil {
+			if fence == "" {
+				fence = match[1]
+			} else if match[1] == fence {
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+
+		lines[i] = pattern.ReplaceAllStringFunc(line, func(link string) string {
+			alias := pattern.FindStringSubmatch(link)[1]
+			return "[[" + newTitle + alias + "]]"
+		})
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// saveNoteLinks replaces the link index entries of a note with the notes its content links to
+func (app *App) saveNoteLinks(noteID int, content string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM note_links WHERE source_id = $1", noteID)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range findWikiLinks(content) {
+		_, err = tx.Exec("INSERT INTO note_links(source_id, target_title) VALUES($1, $2)", noteID, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE notes SET links_indexed = true WHERE id = $1", noteID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// indexNoteLinks adds every note that isn't in the link index yet, such as notes written before wiki links existed
+func (app *App) indexNoteLinks() {
+	type unindexed struct {
+		id      int
+		content string
+	}
+
+	var notes []unindexed
+	rows, err := app.db.Query("SELECT id, content FROM notes WHERE NOT links_indexed")
+	if err != nil {
+		app.log.Println("Error finding notes to index: ", err.Error())
+		return
+	}
+	for rows.Next() {
+		var note unindexed
+		rows.Scan(&note.id, &note.content)
+		notes = append(notes, note)
+	}
+	rows.Close()
+
+	for _, note := range notes {
+		err = app.saveNoteLinks(note.id, note.content)
+		if err != nil {
+			app.log.Println("Error indexing note links: ", err.Error())
+			return
+		}
+	}
+}
+
+// relinkedNotes returns the notes of a user whose links renameWikiLinks rewrites when one of their notes is renamed,
+// with their content. Links are left alone if another note still has the old title.
+func (app *App) relinkedNotes(userID, noteID int, oldTitle, newTitle string) []Note {
+	var notes []Note
+	if wikiLinkKey(oldTitle) == wikiLinkKey(newTitle) || wikiLinkKey(newTitle) == "" || strings.ContainsAny(newTitle, "[]|\n") {
+		return notes
+	}
+
+	var stillExists bool
+	err := app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM notes WHERE user_id = $1 AND lower(trim(title)) = $2 AND id <> $3)", userID, wikiLinkKey(oldTitle), noteID).Scan(&stillExists)
+	if err != nil || stillExists {
+		return notes
+	}
+
+	rows, err := app.db.Query(`SELECT n.id, n.title, n.content, n.version FROM notes n JOIN note_links l ON l.source_id = n.id
+		WHERE n.user_id = $1 AND l.target_title = $2 ORDER BY n.title`, userID, wikiLinkKey(oldTitle))
+	if err != nil {
+		app.log.Println("Error finding links to renamed note: ", err.Error())
+		return notes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note Note
+		rows.Scan(&note.ID, &note.Title, &note.Content, &note.Version)
+		notes = append(notes, note)
+	}
+
+	return notes
+}
+
+// maxRelinkAttempts is how many times renameWikiLinks rewrites a note that keeps being saved in between
+const maxRelinkAttempts = 3
+
+// renameWikiLinks rewrites the links in a user's notes after one of their notes is renamed, so they keep pointing at it.
+// Every note it rewrites gets a new version, so editors open on one of them get a conflict when they save.
+func (app *App) renameWikiLinks(userID, noteID int, oldTitle, newTitle string) {
+	for _, note := range app.relinkedNotes(userID, noteID, oldTitle, newTitle) {
+		err := app.relinkNote(note, oldTitle, strings.TrimSpace(newTitle))
+		if err != nil {
+			app.log.Println("Error updating links to renamed note: ", err.Error())
+		}
+	}
+}
+
+// relinkNote rewrites the links to a renamed note in another note. The note is only written if it is still at the
+// version its content was read at, so an edit saved in between isn't overwritten; the rewrite is tried again on
+// the newer content instead.
+func (app *App) relinkNote(note Note, oldTitle, newTitle string) error {
+	for attempt := 0; attempt < maxRelinkAttempts; attempt++ {
+		content := replaceWikiLinkTarget(note.Content, oldTitle, newTitle)
+		if content == note.Content {
+			return nil
+		}
+
+		result, err := app.db.Exec("UPDATE notes SET content = $1, updated_at = now(), version = version + 1 WHERE id = $2 AND version = $3",
+			content, note.ID, note.Version)
+		if err != nil {
+			return err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if updated == 1 {
+			app.renderCache.invalidate(noteSource(note.ID))
+			err = app.saveNoteLinks(note.ID, content)
+			if err != nil {
+				app.log.Println("Error indexing note links: ", err.Error())
+			}
+			return nil
+		}
+
+		//The note was saved since it was read, so start over from what was saved
+		err = app.db.QueryRow("SELECT content, version FROM notes WHERE id = $1", note.ID).Scan(&note.Content, &note.Version)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("note %d kept changing, its links weren't updated", note.ID)
+}
+
+// getWikiLinks returns the notes of a note's owner that the viewing user can open, for resolving the note's wiki links.
+// Only the owner gets links that create missing notes.
+func (app *App) getWikiLinks(note Note, userID int) *wikiLinks {
+	links := &wikiLinks{
+		notes:  make(map[string]int),
+		create: note.UserID == userID,
+	}
+
+	//Newest first, so the oldest note wins when titles repeat
+	rows, err := app.db.Query(`SELECT n.id, n.title FROM notes n
+		WHERE n.user_id = $1
+		AND (n.user_id = $2 OR EXISTS(SELECT 1 FROM note_permissions p WHERE p.note_id = n.id AND p.user_id = $2))
+		ORDER BY n.id DESC`, note.UserID, userID)
+	if err != nil {
+		app.log.Println("Error getting note titles: ", err.Error())
+		return links
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var title string
+		rows.Scan(&id, &title)
+		links.notes[wikiLinkKey(title)] = id
+	}
+
+	return links
+}
+
+// getBacklinks returns the notes that link to the given note which the viewing user can open
+func (app *App) getBacklinks(note Note, userID int) []Note {
+	var notes []Note
+	rows, err := app.db.Query(`SELECT n.id, n.title FROM notes n JOIN note_links l ON l.source_id = n.id
+		WHERE n.user_id = $1 AND l.target_title = $2 AND n.id <> $3
+		AND (n.user_id = $4 OR EXISTS(SELECT 1 FROM note_permissions p WHERE p.note_id = n.id AND p.user_id = $4))
+		ORDER BY n.title`, note.UserID, wikiLinkKey(note.Title), note.ID, userID)
+	if err != nil {
+		app.log.Println("Error getting backlinks: ", err.Error())
+		return notes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var backlink Note
+		rows.Scan(&backlink.ID, &backlink.Title)
+		notes = append(notes, backlink)
+	}
+
+	return notes
+}
+
+// handleGetBacklinks renders the list of notes linking to a note
+func (app *App) handleGetBacklinks(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	note := app.getNoteByID(id, userID)
+	if note.ID == 0 {
+		app.sendErrorToastNoSwap(w, "Note not found")
+		return
+	}
+
+	err = app.templates.ExecuteTemplate(w, "backlinks", app.getBacklinks(note, userID))
+	if err != nil {
+		app.log.Println("Error executing backlinks template: ", err.Error())
+	}
+}
+
+// findNoteByTitle returns the ID of the user's note with the given title as wiki links match it, or 0 if there is none
+func (app *App) findNoteByTitle(userID int, title string) int {
+	var id int
+	err := app.db.QueryRow("SELECT id FROM notes WHERE user_id = $1 AND lower(trim(title)) = $2 ORDER BY id LIMIT 1", userID, wikiLinkKey(title)).Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.log.Println("Error finding note by title: ", err.Error())
+	}
+	return id
+}
+
+// handleNewNoteFromLink opens the user's note with the title given in the URL, or asks whether to create it if
+// there is none. It is the target of wiki links to notes that don't exist yet, so following one never changes
+// anything by itself.
+func (app *App) handleNewNoteFromLink(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	title := strings.TrimSpace(r.URL.Query().Get("title"))
+	if title == "" {
+		http.Redirect(w, r, "/notes", http.StatusSeeOther)
+		return
+	}
+
+	if id := app.findNoteByTitle(userID, title); id != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/notes/%d", id), http.StatusSeeOther)
+		return
+	}
+
+	var data struct {
+		HeaderData headerData
+		Title      string
+	}
+	data.HeaderData.Title = "New Note"
+	data.Title = title
+
+	err := app.templates.ExecuteTemplate(w, "new_note_page", data)
+	if err != nil {
+		app.log.Println("Error executing new_note_page template: ", err.Error())
+	}
+}
+
+// handleCreateNoteFromLink creates a note with the title from the form request, as confirmed on the page of a
+// wiki link to a note that doesn't exist yet, and opens it in the editor
+func (app *App) handleCreateNoteFromLink(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r)
+	if userID == 0 {
+		app.sendErrorToast(w, "You must be logged in to create notes")
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		app.sendErrorToast(w, "The note needs a title")
+		return
+	}
+
+	//The note may have been created in the meantime, like from another tab
+	if id := app.findNoteByTitle(userID, title); id != 0 {
+		w.Header().Add("HX-Redirect", fmt.Sprintf("/notes/%d", id))
+		return
+	}
+
+	exceeded, err := app.quotaExceeded(userID, Usage{Notes: 1, NoteBytes: int64(len(title))})
+	if err != nil {
+		app.log.Println("Error checking quota: ", err.Error())
+		app.sendErrorToast(w, "Internal server error")
+		return
+	}
+	if exceeded != "" {
+		app.sendErrorToast(w, exceeded)
+		return
+	}
+
+	note := app.postNote(userID, title, "")
+	if note.ID == 0 {
+		app.sendErrorToast(w, "Internal server error")
+		return
+	}
+	w.Header().Add("HX-Redirect", fmt.Sprintf("/notes/%d?edit=true", note.ID))
+}